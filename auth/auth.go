@@ -0,0 +1,84 @@
+package auth
+
+import (
+	"crypto/subtle"
+	"errors"
+	"net/http"
+	"os"
+	"strings"
+
+	"github.com/shiraily/gcal-sync/config"
+	"github.com/shiraily/gcal-sync/logging"
+)
+
+var (
+	// ErrUnauthenticated means request has no credentials
+	ErrUnauthenticated = errors.New("unauthenticated")
+	// ErrForbidden means credentials of request are invalid
+	ErrForbidden = errors.New("forbidden")
+)
+
+// Verifier authenticates requests from scheduler to protected endpoints
+type Verifier struct {
+	// TrustCron accepts X-Appengine-Cron header. Only App Engine removes it from external requests.
+	TrustCron   bool
+	BearerToken string
+	OIDC        *OIDCVerifier
+}
+
+// NewVerifier creates verifier from config. App Engine cron header is trusted only on App Engine.
+func NewVerifier(conf config.AuthConfig) *Verifier {
+	v := &Verifier{
+		TrustCron:   os.Getenv("GAE_ENV") != "",
+		BearerToken: conf.BearerToken,
+	}
+	if conf.OIDC.Audience != "" {
+		v.OIDC = &OIDCVerifier{
+			Audience: conf.OIDC.Audience,
+			Emails:   conf.OIDC.Emails,
+			Keys:     NewGoogleKeys(),
+		}
+	}
+	return v
+}
+
+// Verify returns ErrUnauthenticated or ErrForbidden if request is not allowed
+func (v *Verifier) Verify(r *http.Request) error {
+	if v.TrustCron && r.Header.Get("X-Appengine-Cron") == "true" {
+		return nil
+	}
+	authz := r.Header.Get("Authorization")
+	if !strings.HasPrefix(authz, "Bearer ") {
+		return ErrUnauthenticated
+	}
+	token := strings.TrimPrefix(authz, "Bearer ")
+	if v.BearerToken != "" && subtle.ConstantTimeCompare([]byte(token), []byte(v.BearerToken)) == 1 {
+		return nil
+	}
+	if v.OIDC != nil {
+		if err := v.OIDC.Verify(r.Context(), token); err != nil {
+			logging.Warn("verify OIDC token", "error", err)
+			return ErrForbidden
+		}
+		return nil
+	}
+	return ErrForbidden
+}
+
+// Protect responds 401 or 403 instead of calling next if request is not allowed
+func (v *Verifier) Protect(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		err := v.Verify(r)
+		switch {
+		case errors.Is(err, ErrUnauthenticated):
+			logging.Warn("unauthenticated", "path", r.URL.Path, "error", err)
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			w.WriteHeader(http.StatusUnauthorized)
+		case err != nil:
+			logging.Warn("forbidden", "path", r.URL.Path, "error", err)
+			w.WriteHeader(http.StatusForbidden)
+		default:
+			next(w, r)
+		}
+	}
+}
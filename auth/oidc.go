@@ -0,0 +1,255 @@
+package auth
+
+import (
+	"context"
+	"crypto"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	googleCertsUrl = "https://www.googleapis.com/oauth2/v3/certs"
+	keysCacheTTL   = time.Hour
+	// keysRefetchInterval limits fetches for unknown kid while keys are cached
+	keysRefetchInterval = time.Minute
+)
+
+var googleIssuers = []string{"https://accounts.google.com", "accounts.google.com"}
+
+// KeySource finds public key to verify signature of ID token
+type KeySource interface {
+	Key(ctx context.Context, kid string) (*rsa.PublicKey, error)
+}
+
+// StaticKeys is keys given in advance, such as local keys for tests
+type StaticKeys map[string]*rsa.PublicKey
+
+func (k StaticKeys) Key(ctx context.Context, kid string) (*rsa.PublicKey, error) {
+	key, ok := k[kid]
+	if !ok {
+		return nil, fmt.Errorf("unknown key %s", kid)
+	}
+	return key, nil
+}
+
+// JWKS fetches keys from JSON Web Key Set url and caches them
+type JWKS struct {
+	Url    string
+	Client *http.Client
+
+	// fetchMu lets only one request fetch keys, while others keep reading cached keys under mu
+	fetchMu sync.Mutex
+	mu      sync.Mutex
+	keys    map[string]*rsa.PublicKey
+	fetched time.Time
+	// attempted is the last fetch, which limits fetches for unknown kid
+	attempted time.Time
+	// now is for tests. time.Now if nil
+	now func() time.Time
+}
+
+// NewGoogleKeys is keys signing Google ID tokens, used by Cloud Scheduler and Cloud Tasks
+func NewGoogleKeys() *JWKS {
+	return &JWKS{Url: googleCertsUrl}
+}
+
+// Key returns cached key. Unknown kid fetches keys again since they are rotated, but at most once
+// in keysRefetchInterval, so that tokens with random kid cannot make requests wait for fetches
+// nor flood the JWKS url.
+func (j *JWKS) Key(ctx context.Context, kid string) (*rsa.PublicKey, error) {
+	if key, ok, fetch := j.cached(kid); !fetch {
+		if !ok {
+			return nil, fmt.Errorf("unknown key %s", kid)
+		}
+		return key, nil
+	}
+
+	j.fetchMu.Lock()
+	defer j.fetchMu.Unlock()
+	// another request may have fetched while waiting
+	key, ok, fetch := j.cached(kid)
+	if fetch {
+		j.mu.Lock()
+		j.attempted = j.clock()
+		j.mu.Unlock()
+		keys, err := j.fetch(ctx)
+		j.mu.Lock()
+		if err == nil {
+			j.keys, j.fetched = keys, j.clock()
+		}
+		key, ok = j.keys[kid]
+		j.mu.Unlock()
+		if err != nil && !ok {
+			return nil, err
+		}
+	}
+	if !ok {
+		return nil, fmt.Errorf("unknown key %s", kid)
+	}
+	return key, nil
+}
+
+// cached looks up kid in cache, and tells whether keys should be fetched
+func (j *JWKS) cached(kid string) (key *rsa.PublicKey, ok bool, fetch bool) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	now := j.clock()
+	key, ok = j.keys[kid]
+	expired := now.Sub(j.fetched) >= keysCacheTTL
+	if ok && !expired {
+		return key, true, false
+	}
+	return key, ok, expired || now.Sub(j.attempted) >= keysRefetchInterval
+}
+
+func (j *JWKS) clock() time.Time {
+	if j.now != nil {
+		return j.now()
+	}
+	return time.Now()
+}
+
+func (j *JWKS) fetch(ctx context.Context) (map[string]*rsa.PublicKey, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, j.Url, nil)
+	if err != nil {
+		return nil, err
+	}
+	cli := j.Client
+	if cli == nil {
+		cli = http.DefaultClient
+	}
+	res, err := cli.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("fetch keys: %s", err)
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("fetch keys: status %d", res.StatusCode)
+	}
+	var set struct {
+		Keys []struct {
+			Kid string `json:"kid"`
+			Kty string `json:"kty"`
+			N   string `json:"n"`
+			E   string `json:"e"`
+		} `json:"keys"`
+	}
+	if err := json.NewDecoder(res.Body).Decode(&set); err != nil {
+		return nil, fmt.Errorf("parse keys: %s", err)
+	}
+	keys := map[string]*rsa.PublicKey{}
+	for _, k := range set.Keys {
+		if k.Kty != "RSA" {
+			continue
+		}
+		n, err := base64.RawURLEncoding.DecodeString(k.N)
+		if err != nil {
+			return nil, fmt.Errorf("parse key %s: %s", k.Kid, err)
+		}
+		e, err := base64.RawURLEncoding.DecodeString(k.E)
+		if err != nil {
+			return nil, fmt.Errorf("parse key %s: %s", k.Kid, err)
+		}
+		keys[k.Kid] = &rsa.PublicKey{
+			N: new(big.Int).SetBytes(n),
+			E: int(new(big.Int).SetBytes(e).Int64()),
+		}
+	}
+	return keys, nil
+}
+
+// OIDCVerifier verifies Google-signed ID token sent by Cloud Scheduler or Cloud Tasks
+type OIDCVerifier struct {
+	Audience string
+	// Emails are service accounts allowed. Required, since any Google account can get ID token for any audience.
+	Emails []string
+	Keys   KeySource
+	// Now is for tests. time.Now if nil
+	Now func() time.Time
+}
+
+type claims struct {
+	Iss           string `json:"iss"`
+	Aud           string `json:"aud"`
+	Exp           int64  `json:"exp"`
+	Iat           int64  `json:"iat"`
+	Email         string `json:"email"`
+	EmailVerified bool   `json:"email_verified"`
+}
+
+func (v *OIDCVerifier) Verify(ctx context.Context, token string) error {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return errors.New("malformed token")
+	}
+	var header struct {
+		Alg string `json:"alg"`
+		Kid string `json:"kid"`
+	}
+	if err := decodeSegment(parts[0], &header); err != nil {
+		return fmt.Errorf("header: %s", err)
+	}
+	if header.Alg != "RS256" {
+		return fmt.Errorf("unsupported alg %s", header.Alg)
+	}
+	key, err := v.Keys.Key(ctx, header.Kid)
+	if err != nil {
+		return err
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return fmt.Errorf("signature: %s", err)
+	}
+	digest := sha256.Sum256([]byte(parts[0] + "." + parts[1]))
+	if err := rsa.VerifyPKCS1v15(key, crypto.SHA256, digest[:], sig); err != nil {
+		return fmt.Errorf("signature: %s", err)
+	}
+
+	var c claims
+	if err := decodeSegment(parts[1], &c); err != nil {
+		return fmt.Errorf("claims: %s", err)
+	}
+	now := time.Now
+	if v.Now != nil {
+		now = v.Now
+	}
+	if !contains(googleIssuers, c.Iss) {
+		return fmt.Errorf("unexpected issuer %s", c.Iss)
+	}
+	if c.Aud != v.Audience {
+		return fmt.Errorf("unexpected audience %s", c.Aud)
+	}
+	if now().Unix() >= c.Exp {
+		return errors.New("token expired")
+	}
+	if !c.EmailVerified || !contains(v.Emails, c.Email) {
+		return fmt.Errorf("unexpected email %s", c.Email)
+	}
+	return nil
+}
+
+func decodeSegment(seg string, v interface{}) error {
+	b, err := base64.RawURLEncoding.DecodeString(seg)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(b, v)
+}
+
+func contains(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
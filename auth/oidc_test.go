@@ -0,0 +1,330 @@
+package auth
+
+import (
+	"context"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+const (
+	testAudience = "https://example.com/renew"
+	testEmail    = "scheduler@project.iam.gserviceaccount.com"
+)
+
+// jwksServer serves public keys of keys as JSON Web Key Set, and counts fetches
+type jwksServer struct {
+	*httptest.Server
+	mu      sync.Mutex
+	keys    map[string]*rsa.PrivateKey
+	fetches int
+}
+
+func newJWKSServer(t *testing.T) *jwksServer {
+	s := &jwksServer{keys: map[string]*rsa.PrivateKey{}}
+	s.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		s.fetches++
+		type jwk struct {
+			Kid string `json:"kid"`
+			Kty string `json:"kty"`
+			N   string `json:"n"`
+			E   string `json:"e"`
+		}
+		var set struct {
+			Keys []jwk `json:"keys"`
+		}
+		for kid, key := range s.keys {
+			set.Keys = append(set.Keys, jwk{
+				Kid: kid,
+				Kty: "RSA",
+				N:   base64.RawURLEncoding.EncodeToString(key.N.Bytes()),
+				E:   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(key.E)).Bytes()),
+			})
+		}
+		json.NewEncoder(w).Encode(set)
+	}))
+	t.Cleanup(s.Close)
+	return s
+}
+
+// addKey generates key and publishes it
+func (s *jwksServer) addKey(t *testing.T, kid string) *rsa.PrivateKey {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.mu.Lock()
+	s.keys[kid] = key
+	s.mu.Unlock()
+	return key
+}
+
+func (s *jwksServer) fetched() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.fetches
+}
+
+func validClaims(now time.Time) claims {
+	return claims{
+		Iss:           "https://accounts.google.com",
+		Aud:           testAudience,
+		Iat:           now.Unix(),
+		Exp:           now.Add(time.Hour).Unix(),
+		Email:         testEmail,
+		EmailVerified: true,
+	}
+}
+
+func sign(t *testing.T, key *rsa.PrivateKey, kid string, c claims) string {
+	t.Helper()
+	header, err := json.Marshal(map[string]string{"alg": "RS256", "typ": "JWT", "kid": kid})
+	if err != nil {
+		t.Fatal(err)
+	}
+	payload, err := json.Marshal(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signed := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(payload)
+	digest := sha256.Sum256([]byte(signed))
+	sig, err := rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, digest[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	return signed + "." + base64.RawURLEncoding.EncodeToString(sig)
+}
+
+func TestOIDCVerifier(t *testing.T) {
+	jwks := newJWKSServer(t)
+	key := jwks.addKey(t, "k1")
+	other, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now()
+
+	tests := []struct {
+		name    string
+		token   func() string
+		wantErr string
+	}{
+		{"valid", func() string {
+			return sign(t, key, "k1", validClaims(now))
+		}, ""},
+		{"bad signature", func() string {
+			return sign(t, other, "k1", validClaims(now))
+		}, "signature"},
+		{"tampered claims", func() string {
+			token := sign(t, key, "k1", validClaims(now))
+			c := validClaims(now)
+			c.Email = "attacker@example.com"
+			payload, _ := json.Marshal(c)
+			parts := strings.Split(token, ".")
+			return parts[0] + "." + base64.RawURLEncoding.EncodeToString(payload) + "." + parts[2]
+		}, "signature"},
+		{"wrong audience", func() string {
+			c := validClaims(now)
+			c.Aud = "https://example.com/other"
+			return sign(t, key, "k1", c)
+		}, "unexpected audience"},
+		{"wrong issuer", func() string {
+			c := validClaims(now)
+			c.Iss = "https://example.com"
+			return sign(t, key, "k1", c)
+		}, "unexpected issuer"},
+		{"expired", func() string {
+			c := validClaims(now.Add(-2 * time.Hour))
+			return sign(t, key, "k1", c)
+		}, "expired"},
+		{"email not allowed", func() string {
+			c := validClaims(now)
+			c.Email = "someone@gmail.com"
+			return sign(t, key, "k1", c)
+		}, "unexpected email"},
+		{"email not verified", func() string {
+			c := validClaims(now)
+			c.EmailVerified = false
+			return sign(t, key, "k1", c)
+		}, "unexpected email"},
+		{"malformed", func() string {
+			return "not-a-token"
+		}, "malformed"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			v := &OIDCVerifier{
+				Audience: testAudience,
+				Emails:   []string{testEmail},
+				Keys:     &JWKS{Url: jwks.URL},
+				Now:      func() time.Time { return now },
+			}
+			err := v.Verify(context.Background(), tt.token())
+			if tt.wantErr == "" {
+				if err != nil {
+					t.Errorf("want no error, got %s", err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("want error containing %q, got %v", tt.wantErr, err)
+			}
+		})
+	}
+}
+
+func TestOIDCVerifierWithoutEmails(t *testing.T) {
+	jwks := newJWKSServer(t)
+	key := jwks.addKey(t, "k1")
+	v := &OIDCVerifier{Audience: testAudience, Keys: &JWKS{Url: jwks.URL}}
+	if err := v.Verify(context.Background(), sign(t, key, "k1", validClaims(time.Now()))); err == nil {
+		t.Error("want error without emails allowed")
+	}
+}
+
+// fakeClock is time of JWKS advanced by tests
+type fakeClock struct {
+	mu sync.Mutex
+	t  time.Time
+}
+
+func (c *fakeClock) now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.t
+}
+
+func (c *fakeClock) advance(d time.Duration) {
+	c.mu.Lock()
+	c.t = c.t.Add(d)
+	c.mu.Unlock()
+}
+
+func TestJWKSRefreshesUnknownKid(t *testing.T) {
+	jwks := newJWKSServer(t)
+	key := jwks.addKey(t, "k1")
+	clock := &fakeClock{t: time.Now()}
+	v := &OIDCVerifier{
+		Audience: testAudience,
+		Emails:   []string{testEmail},
+		Keys:     &JWKS{Url: jwks.URL, now: clock.now},
+	}
+	ctx := context.Background()
+
+	if err := v.Verify(ctx, sign(t, key, "k1", validClaims(time.Now()))); err != nil {
+		t.Fatal(err)
+	}
+	if err := v.Verify(ctx, sign(t, key, "k1", validClaims(time.Now()))); err != nil {
+		t.Fatal(err)
+	}
+	if n := jwks.fetched(); n != 1 {
+		t.Errorf("cached keys: want 1 fetch, got %d", n)
+	}
+
+	// Google rotates keys, so token signed by new key arrives before keys cached are expired
+	rotated := jwks.addKey(t, "k2")
+	clock.advance(keysRefetchInterval)
+	if err := v.Verify(ctx, sign(t, rotated, "k2", validClaims(time.Now()))); err != nil {
+		t.Errorf("rotated key: %s", err)
+	}
+	if n := jwks.fetched(); n != 2 {
+		t.Errorf("unknown kid: want 2 fetches, got %d", n)
+	}
+
+	if err := v.Verify(ctx, sign(t, rotated, "k3", validClaims(time.Now()))); err == nil ||
+		!strings.Contains(err.Error(), "unknown key") {
+		t.Errorf("want unknown key, got %v", err)
+	}
+	if n := jwks.fetched(); n != 2 {
+		t.Errorf("unknown kid just after fetch: want 2 fetches, got %d", n)
+	}
+
+	// expired cache is fetched again regardless of kid
+	clock.advance(keysCacheTTL)
+	if err := v.Verify(ctx, sign(t, key, "k1", validClaims(time.Now()))); err != nil {
+		t.Fatal(err)
+	}
+	if n := jwks.fetched(); n != 3 {
+		t.Errorf("expired cache: want 3 fetches, got %d", n)
+	}
+}
+
+func TestJWKSLimitsFetchesOfUnknownKid(t *testing.T) {
+	jwks := newJWKSServer(t)
+	key := jwks.addKey(t, "k1")
+	keys := &JWKS{Url: jwks.URL}
+	v := &OIDCVerifier{Audience: testAudience, Emails: []string{testEmail}, Keys: keys}
+	ctx := context.Background()
+
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			kid := fmt.Sprintf("garbage%d", i)
+			if err := v.Verify(ctx, sign(t, key, kid, validClaims(time.Now()))); err == nil {
+				t.Errorf("%s: want error", kid)
+			}
+		}(i)
+	}
+	wg.Wait()
+	if n := jwks.fetched(); n != 1 {
+		t.Errorf("want 1 fetch for unknown kids, got %d", n)
+	}
+	// known kid is served from cache
+	if err := v.Verify(ctx, sign(t, key, "k1", validClaims(time.Now()))); err != nil {
+		t.Fatal(err)
+	}
+	if n := jwks.fetched(); n != 1 {
+		t.Errorf("want 1 fetch, got %d", n)
+	}
+}
+
+func TestVerifierProtect(t *testing.T) {
+	jwks := newJWKSServer(t)
+	key := jwks.addKey(t, "k1")
+	v := &Verifier{
+		BearerToken: "secret",
+		OIDC:        &OIDCVerifier{Audience: testAudience, Emails: []string{testEmail}, Keys: &JWKS{Url: jwks.URL}},
+	}
+	h := v.Protect(func(w http.ResponseWriter, r *http.Request) {})
+	other, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tt := range []struct {
+		name   string
+		authz  string
+		status int
+	}{
+		{"no header", "", http.StatusUnauthorized},
+		{"bearer token", "Bearer secret", http.StatusOK},
+		{"id token", "Bearer " + sign(t, key, "k1", validClaims(time.Now())), http.StatusOK},
+		{"bad id token", "Bearer " + sign(t, other, "k1", validClaims(time.Now())), http.StatusForbidden},
+		{"wrong token", "Bearer wrong", http.StatusForbidden},
+	} {
+		r := httptest.NewRequest(http.MethodPost, "/renew", nil)
+		if tt.authz != "" {
+			r.Header.Set("Authorization", tt.authz)
+		}
+		w := httptest.NewRecorder()
+		h(w, r)
+		if w.Code != tt.status {
+			t.Errorf("%s: want %d, got %d", tt.name, tt.status, w.Code)
+		}
+	}
+}
@@ -5,20 +5,24 @@ import (
 	"errors"
 	"fmt"
 	"io/ioutil"
-	"log"
-	"regexp"
+	"net/http"
 	"strings"
 	"time"
 
-	"cloud.google.com/go/firestore"
-	firebase "firebase.google.com/go"
 	"github.com/google/uuid"
+	"go.opentelemetry.io/otel/attribute"
+	"golang.org/x/oauth2"
 	"golang.org/x/oauth2/google"
 	"google.golang.org/api/calendar/v3"
 	"google.golang.org/api/option"
 
 	"github.com/shiraily/gcal-sync/config"
+	"github.com/shiraily/gcal-sync/logging"
+	"github.com/shiraily/gcal-sync/metrics"
 	"github.com/shiraily/gcal-sync/oauth"
+	"github.com/shiraily/gcal-sync/retry"
+	"github.com/shiraily/gcal-sync/store"
+	"github.com/shiraily/gcal-sync/tracing"
 )
 
 const (
@@ -35,31 +39,24 @@ var (
 )
 
 type Client struct {
-	ctx   context.Context
-	conf  *config.Config
-	svc   *calendar.Service
-	fsCli *firestore.Client
+	ctx    context.Context
+	conf   *config.Config
+	tenant *config.Tenant
+	svc    *calendar.Service
+	store  store.StateStore
+	// isPooled client shares services with Pool, so Close does nothing
+	isPooled bool
+	// trigger is recorded in runs of sync
+	trigger string
+	dryRun  bool
 }
 
-func NewClient() Client {
-	cli := &Client{}
-	// envs
-	cli.conf = config.GetConfig()
-	cli.ctx = context.Background()
-
-	srcSrv, err := NewCalendarServiceWithServiceAccount(cli.ctx, serviceAccountClientSecret)
-	if err != nil {
-		log.Fatalf("Retrieve Calendar client: %s", err)
-	}
-	cli.svc = srcSrv
-
-	cli.fsCli, err = cli.NewFirestoreApp(serviceAccountClientSecret)
-	if err != nil {
-		log.Fatalf("Create firestore cli: %s", err)
-	}
-
-	return *cli
-}
+// triggers of sync recorded in run history
+const (
+	TriggerNotification = "notification"
+	TriggerPoll         = "poll"
+	TriggerManual       = "manual"
+)
 
 func NewCalendarService(ctx context.Context, credentialFile, oauthTokenFile string) (*calendar.Service, error) {
 	b, err := ioutil.ReadFile(credentialFile)
@@ -75,269 +72,556 @@ func NewCalendarService(ctx context.Context, credentialFile, oauthTokenFile stri
 	if err != nil {
 		return nil, fmt.Errorf("read OAuth token: %s", err)
 	}
+	// base transport of oauth client keeps Retry-After
+	ctx = context.WithValue(ctx, oauth2.HTTPClient, &http.Client{Transport: &retry.Transport{}})
 	return calendar.NewService(ctx, option.WithHTTPClient(config.Client(ctx, tok)))
 }
 
-func (cli *Client) NewFirestoreApp(credentialFile string) (*firestore.Client, error) {
-	app, err := firebase.NewApp(cli.ctx, &firebase.Config{ProjectID: cli.conf.Project}, option.WithCredentialsFile(credentialFile))
-	if err != nil {
-		return nil, err
+func (cli *Client) Close() {
+	if cli.isPooled {
+		return
 	}
-	return app.Firestore(cli.ctx)
+	cli.store.Close()
 }
 
-func (cli *Client) Close() {
-	cli.fsCli.Close()
+// WithContext returns copy of the client using ctx, such as one carrying logger with correlation id
+func (cli *Client) WithContext(ctx context.Context) *Client {
+	c := *cli
+	c.ctx = ctx
+	return &c
+}
+
+// WithTrigger returns copy of the client recording trigger in runs of sync
+func (cli *Client) WithTrigger(trigger string) *Client {
+	c := *cli
+	c.trigger = trigger
+	return &c
+}
+
+// logger writes logs with fields in context of the client
+func (cli *Client) logger() *logging.Logger {
+	return logging.FromContext(cli.ctx).With("tenant", cli.tenant.Id)
 }
 
+// TenantId returns id of the tenant served by this client
+func (cli *Client) TenantId() string {
+	return cli.tenant.Id
+}
+
+// SyncInitial gets the first sync token on channel handshake. It does nothing if a token already exists,
+// since stray handshakes must not discard changes not synced yet.
 func (cli *Client) SyncInitial() error {
+	current, err := cli.readToken()
+	if err != nil {
+		return err
+	}
+	if current != "" {
+		cli.logger().Info("sync token already exists. skip initial sync")
+		return nil
+	}
 	t := time.Now().Format(time.RFC3339)
-	events, err := cli.svc.Events.List(cli.conf.SrcCalId).ShowDeleted(false).
-		SingleEvents(false).TimeMin(t).Do()
+	_, nextToken, err := cli.listAll("get first token", cli.svc.Events.List(cli.tenant.SrcCalId).ShowDeleted(false).
+		SingleEvents(false).TimeMin(t))
 	if err != nil {
-		return fmt.Errorf("get first token: %s", err)
+		return err
 	}
-	if err := cli.saveToken(events.NextSyncToken); err != nil {
+	if cli.skipWrite("save first token", "token", logging.Secret(nextToken)) {
+		return nil
+	}
+	err = cli.store.CompareAndSwapToken(cli.ctx, cli.tenant.Id, "", nextToken)
+	if errors.Is(err, store.ErrTokenConflict) {
+		cli.logger().Info("sync token was saved by another sync. skip initial sync")
+		return nil
+	} else if err != nil {
 		return err
 	}
-	log.Printf("Initial full sync got token: %s", events.NextSyncToken)
+	cli.logger().Info("initial full sync got token", "token", logging.Secret(nextToken))
 	return nil
 }
 
+// Sync creates events for changes after the saved token.
+// Only one sync of the calendar runs at a time, and calls during it are coalesced into one more run.
 func (cli *Client) Sync() error {
+	_, err := cli.SyncChanges()
+	return err
+}
+
+// SyncChanges is Sync returning number of changed source events
+func (cli *Client) SyncChanges() (int, error) {
+	key := cli.syncKey()
+	if !syncGate.enter(key) {
+		cli.logger().Info("sync is running. will sync again after it", "calendar", cli.tenant.SrcCalId)
+		return 0, nil
+	}
+	seen := 0
+	for {
+		res, err := cli.syncWithLock(key, (*Client).sync)
+		seen += res.seen
+		if !syncGate.next(key) {
+			return seen, err
+		}
+		if err != nil {
+			cli.logger().Warn("sync before follow-up failed", "error", err)
+		}
+	}
+}
+
+// Poll syncs changes, or gets the first token if none exists since no handshake arrives without channel
+func (cli *Client) Poll() (int, error) {
+	cli = cli.WithTrigger(TriggerPoll)
+	token, err := cli.readToken()
+	if err != nil {
+		return 0, err
+	}
+	if token == "" {
+		return 0, cli.SyncInitial()
+	}
+	return cli.SyncChanges()
+}
+
+type syncResult struct {
+	created     int
+	seen        int
+	tokenBefore string
+	tokenAfter  string
+	audit       []store.AuditEntry
+}
+
+// Resync discards the saved token and syncs all upcoming events, such as after the token was lost
+// or notifications were missed for long. Events already blocked follow their changes by mappings.
+func (cli *Client) Resync() (int, error) {
+	res, err := cli.syncWithLock(cli.syncKey(), (*Client).resync)
+	return res.seen, err
+}
+
+// syncKey identifies the source calendar of the tenant, for which only one sync runs at a time
+func (cli *Client) syncKey() string {
+	return cli.tenant.Id + ":" + cli.tenant.SrcCalId
+}
+
+// syncWithLock runs f under lock of the calendar and records the run
+func (cli *Client) syncWithLock(key string, f func(cli *Client) (syncResult, error)) (res syncResult, err error) {
+	ctx, span := tracing.Start(cli.ctx, "sync", attribute.String("tenant", cli.tenant.Id))
+	defer func() {
+		span.SetAttributes(attribute.Int("events", res.seen), attribute.Int("created", res.created))
+		tracing.End(span, err)
+	}()
+	cli = cli.WithContext(ctx)
+
+	unlock, err := cli.lock(cli.ctx, "sync:"+key, uuid.New().String(), syncLockTTL, syncLockWait)
+	if err != nil {
+		return syncResult{}, err
+	}
+	defer unlock()
+
+	trigger := cli.trigger
+	if trigger == "" {
+		trigger = TriggerManual
+	}
+	run := store.Run{Id: uuid.New().String(), Started: time.Now(), Trigger: trigger}
+	span.SetAttributes(attribute.String("run_id", run.Id))
+	cli = cli.WithContext(logging.WithFields(cli.ctx, "run_id", run.Id))
+	res, err = f(cli)
+	run.Finished = time.Now()
+	result := "ok"
+	if err != nil {
+		result = "error"
+	}
+	metrics.SyncsRun.WithLabelValues(cli.tenant.Id, result).Inc()
+	metrics.SyncDuration.WithLabelValues(cli.tenant.Id).Observe(run.Finished.Sub(run.Started).Seconds())
+	metrics.EventsProcessed.WithLabelValues(cli.tenant.Id).Add(float64(res.seen))
+	metrics.EventsPerSync.WithLabelValues(cli.tenant.Id).Observe(float64(res.seen))
+	run.Created = res.created
+	run.Seen = res.seen
+	run.TokenBefore, run.TokenAfter = res.tokenBefore, res.tokenAfter
+	if err != nil {
+		run.Error = err.Error()
+	}
+	var serr *SyncError
+	if errors.As(err, &serr) {
+		for _, item := range serr.Items {
+			run.Failures = append(run.Failures, store.Failure{
+				EventId:   item.EventId,
+				Error:     item.Err.Error(),
+				Transient: IsTransient(item.Err),
+			})
+		}
+	}
+	if cli.skipWrite("save run", "trigger", run.Trigger, "seen", run.Seen, "created", run.Created, "actions", len(res.audit)) {
+		return res, err
+	}
+	if err := cli.store.SaveRun(cli.ctx, cli.tenant.Id, run); err != nil {
+		cli.logger().Error("save run", "error", err)
+	}
+	for i := range res.audit {
+		res.audit[i].RunId = run.Id
+	}
+	if err := cli.store.SaveAudit(cli.ctx, cli.tenant.Id, res.audit); err != nil {
+		cli.logger().Error("save audit", "error", err)
+	}
+	return res, err
+}
+
+func (cli *Client) sync() (syncResult, error) {
 	nextToken, err := cli.readToken()
 	if err != nil {
-		return err
+		return syncResult{}, err
 	}
 	if nextToken == "" {
-		return errors.New("nextSyncToken is empty")
+		return syncResult{}, errors.New("nextSyncToken is empty")
 	}
 
-	log.Printf("use token: %s", nextToken)
-	events, err := cli.svc.Events.List(cli.conf.SrcCalId).SyncToken(nextToken).Do()
+	res := syncResult{tokenBefore: nextToken, tokenAfter: nextToken}
+	cli.logger().Debug("use token", "token", logging.Secret(nextToken))
+	items, newToken, err := cli.listAll("retrieve next events", cli.svc.Events.List(cli.tenant.SrcCalId).SyncToken(nextToken))
 	if err != nil {
-		return fmt.Errorf("retrieve next events: %s", err)
+		return res, err
 	}
 
-	if err := cli.saveToken(events.NextSyncToken); err != nil {
-		return err
+	// another sync may have processed same changes if lock expired
+	if cli.skipWrite("save token", "token", logging.Secret(newToken)) {
+		err = nil
+	} else {
+		err = cli.store.CompareAndSwapToken(cli.ctx, cli.tenant.Id, nextToken, newToken)
 	}
+	if errors.Is(err, store.ErrTokenConflict) {
+		cli.logger().Info("skip changes already processed", "error", err)
+		return res, nil
+	} else if err != nil {
+		return res, err
+	}
+	res.tokenAfter = newToken
 
-	if len(events.Items) == 0 {
-		log.Println("No upcoming events found.")
-		return nil
+	if len(items) == 0 {
+		cli.logger().Info("no upcoming events found")
+		return res, nil
 	}
-	var ids []string
-	for _, item := range events.Items {
-		destEvtId, err := cli.create(item)
+	serr := cli.syncItems(items, &res)
+	if serr == nil {
+		return res, nil
+	}
+	if serr.Temporary() && !cli.DryRun() {
+		// sync the changes again on retry. events already synced are skipped by their mappings.
+		err := cli.store.CompareAndSwapToken(cli.ctx, cli.tenant.Id, newToken, nextToken)
 		if err != nil {
-			log.Fatalf("Skipped %s %s: %s", item.Id, item.Summary, err)
-		} else if destEvtId == nil {
-			log.Printf("Not target: %s", item.Summary)
+			cli.logger().Warn("keep token after failure", "error", err)
 		} else {
-			ids = append(ids, *destEvtId)
+			res.tokenAfter = nextToken
 		}
 	}
-	log.Printf("created: %s", strings.Join(ids, ", "))
-	return nil
+	return res, serr
 }
 
-func (cli *Client) readToken() (string, error) {
-	doc, err := cli.fsCli.Collection("calendar").Doc("channel").Get(cli.ctx)
-	if err != nil {
-		return "", fmt.Errorf("sync token: %s", err)
+// syncItems syncs each event, recording actions in res. Failure of an event does not stop others.
+func (cli *Client) syncItems(items []*calendar.Event, res *syncResult) *SyncError {
+	var ids []string
+	var failed []*ItemError
+	for _, item := range items {
+		entry, err := cli.syncItem(item)
+		if err != nil {
+			cli.logger().Warn("skipped event", "event_id", item.Id, "title", logging.Title(item.Summary), "error", err)
+			failed = append(failed, &ItemError{EventId: item.Id, Err: err})
+			continue
+		}
+		if entry.Action == actionCreated {
+			ids = append(ids, entry.DestEventId)
+		}
+		if entry.Action != actionKept {
+			res.audit = append(res.audit, entry)
+		}
 	}
-	token, _ := doc.Data()["nextSyncToken"].(string)
-	return token, nil
+	cli.logger().Info("synced", "events", len(items), "created", strings.Join(ids, ","), "failed", len(failed))
+	res.created, res.seen = len(ids), len(items)
+	if len(failed) == 0 {
+		return nil
+	}
+	return &SyncError{Items: failed}
 }
 
-func (cli *Client) saveToken(syncToken string) error {
-	if syncToken == "" {
-		return errors.New("cannot save empty nextSyncToken")
+// resync lists all upcoming events instead of changes, and saves the new token unless retry is needed
+func (cli *Client) resync() (syncResult, error) {
+	oldToken, err := cli.readToken()
+	if err != nil {
+		return syncResult{}, err
 	}
-	_, err := cli.fsCli.Collection("calendar").Doc("channel").Update(
-		cli.ctx,
-		[]firestore.Update{{Path: "nextSyncToken", Value: syncToken}},
-	)
+	res := syncResult{tokenBefore: oldToken, tokenAfter: oldToken}
+	items, nextToken, err := cli.listAll("list upcoming events", cli.svc.Events.List(cli.tenant.SrcCalId).
+		ShowDeleted(false).SingleEvents(false).TimeMin(time.Now().Format(time.RFC3339)))
 	if err != nil {
-		return fmt.Errorf("sync token: %s", err)
+		return res, err
 	}
-	return nil
+
+	serr := cli.syncItems(items, &res)
+	if serr != nil && serr.Temporary() {
+		// keep the old token so that resync is run again
+		return res, serr
+	}
+	if !cli.skipWrite("save token", "token", logging.Secret(nextToken)) {
+		err := cli.store.CompareAndSwapToken(cli.ctx, cli.tenant.Id, oldToken, nextToken)
+		if errors.Is(err, store.ErrTokenConflict) {
+			cli.logger().Info("token was saved by another sync. keep it", "error", err)
+		} else if err != nil {
+			return res, err
+		} else {
+			res.tokenAfter = nextToken
+		}
+	}
+	if serr != nil {
+		return res, serr
+	}
+	return res, nil
 }
 
-func (cli *Client) create(srcEvt *calendar.Event) (*string, error) {
-	evt := cli.newEvent(srcEvt)
-	if evt == nil {
-		return nil, nil
+// listAll reads all pages of call. Only the last page has sync token, which must not be empty
+// since saving it would break every later sync.
+func (cli *Client) listAll(op string, call *calendar.EventsListCall) ([]*calendar.Event, string, error) {
+	var items []*calendar.Event
+	for {
+		events, err := cli.doEvents("list", call)
+		if err != nil {
+			return nil, "", classify(op, err)
+		}
+		items = append(items, events.Items...)
+		if events.NextPageToken != "" {
+			call = call.PageToken(events.NextPageToken)
+			continue
+		}
+		if events.NextSyncToken == "" {
+			return nil, "", permanent(op, errors.New("empty nextSyncToken on the last page"))
+		}
+		return items, events.NextSyncToken, nil
 	}
+}
 
-	events, err := cli.svc.Events.List(cli.conf.DestCalId).TimeMin(evt.Start.DateTime).TimeMax(evt.End.DateTime).Do()
+// syncItem creates block for the event, or makes existing block follow it.
+// It returns audit entry of the action taken.
+func (cli *Client) syncItem(item *calendar.Event) (store.AuditEntry, error) {
+	m, err := cli.store.ReadMapping(cli.ctx, cli.tenant.Id, item.Id)
 	if err != nil {
-		return nil, fmt.Errorf("list existing events: %w", err)
+		return store.AuditEntry{}, transient("read mapping", err)
 	}
-	existingEvents := events.Items
-	isCovered := false
-	start, _ := time.Parse(gcalTimeFormat, evt.Start.DateTime)
-	end, _ := time.Parse(gcalTimeFormat, evt.End.DateTime)
-	for _, existingEvent := range existingEvents {
-		startExisting, _ := time.Parse(gcalTimeFormat, existingEvent.Start.DateTime)
-		endExisting, _ := time.Parse(gcalTimeFormat, existingEvent.End.DateTime)
-		// evtが既存の予定の時間帯に収まるなら作らない
-		if !start.Before(startExisting) && !end.After(endExisting) {
-			isCovered = true
-			break
+	if m != nil {
+		// block exists, so follows change of the event
+		entry, err := cli.reconcileBlock(*m, item)
+		if err != nil {
+			return entry, err
 		}
+		metrics.Blocks.WithLabelValues(cli.tenant.Id, entry.Action).Inc()
+		cli.logger().Info("block synced", "action", entry.Action, "event_id", item.Id, "title", logging.Title(item.Summary))
+		return entry, nil
 	}
-	if isCovered {
-		return nil, nil
+	entry, err := cli.create(item)
+	if err != nil {
+		return entry, err
 	}
+	if entry.Action == actionSkipped {
+		cli.logger().Debug("not target", "event_id", item.Id, "title", logging.Title(item.Summary), "reason", entry.Reason)
+	}
+	return entry, nil
+}
 
-	destEvt, err := cli.svc.Events.Insert(cli.conf.DestCalId, evt).Do()
-	if err != nil {
-		return nil, fmt.Errorf("create: %w", err)
+// newAudit returns audit entry of action for source event
+func newAudit(action, srcEventId, destEventId string) store.AuditEntry {
+	return store.AuditEntry{
+		Id:          uuid.New().String(),
+		Time:        time.Now(),
+		Action:      action,
+		SrcEventId:  srcEventId,
+		DestEventId: destEventId,
 	}
-	return &destEvt.Id, nil
 }
 
-const defaultOffset = 30
+func (cli *Client) readToken() (string, error) {
+	return cli.store.ReadToken(cli.ctx, cli.tenant.Id)
+}
 
-func (cli *Client) newEvent(srcEvt *calendar.Event) *calendar.Event {
-	if srcEvt.Status != "confirmed" { // キャンセル等
-		// TODO: キャンセルや変更の場合は作成済みイベントを削除したい
-		return nil
-	}
-	if srcEvt.Start.DateTime == "" { // 終日
-		return nil
+func (cli *Client) create(srcEvt *calendar.Event) (store.AuditEntry, error) {
+	d := cli.decide(srcEvt)
+	if d.ruleLabel != "" {
+		metrics.RuleHits.WithLabelValues(cli.tenant.Id, d.ruleLabel).Inc()
 	}
-
-	start, _ := time.Parse(gcalTimeFormat, srcEvt.Start.DateTime)
-	end, _ := time.Parse(gcalTimeFormat, srcEvt.End.DateTime)
-	// 週末開始か終了なら無視
-	if w := start.Weekday(); w == time.Saturday || w == time.Sunday {
-		return nil
-	} else if w := end.Weekday(); w == time.Saturday || w == time.Sunday {
-		return nil
-	} else if (start.Hour() >= 22) || (end.Hour() <= 9) {
-		return nil
+	evt := d.evt
+	if evt == nil {
+		metrics.BlocksSkipped.WithLabelValues(cli.tenant.Id, d.skip).Inc()
+		entry := newAudit(actionSkipped, srcEvt.Id, "")
+		entry.Rule, entry.Reason = d.rule, d.skip
+		return entry, nil
 	}
 
-	matched := false
-	for _, rule := range cli.conf.Rules {
-		if regexp.MustCompile(rule.Match).MatchString(srcEvt.Summary) {
-			if rule.Ignore {
-				return nil
-			}
-			start = add(start, rule.StartOffset)
-			end = add(end, rule.EndOffset)
-			matched = true
-			break
-		}
-	}
-	if !matched {
-		// Google Meetなどがない場合はデフォルト
-		if srcEvt.ConferenceData == nil || srcEvt.ConferenceData.ConferenceSolution == nil {
-			start = add(start, -defaultOffset)
-			end = add(end, defaultOffset)
-		}
+	isCovered, err := cli.isCovered(evt)
+	if err != nil {
+		return store.AuditEntry{}, err
 	}
-	return &calendar.Event{
-		Summary: "ブロック",
-		Start: &calendar.EventDateTime{
-			DateTime: start.Format(gcalTimeFormat),
-		},
-		End: &calendar.EventDateTime{
-			DateTime: end.Format(gcalTimeFormat),
-		},
+	if isCovered {
+		metrics.BlocksSkipped.WithLabelValues(cli.tenant.Id, skipCovered).Inc()
+		entry := newAudit(actionSkipped, srcEvt.Id, "")
+		entry.Rule, entry.Reason = d.rule, skipCovered
+		return entry, nil
 	}
-}
 
-func (cli *Client) StartWatch() (string, error) {
-	ch, err := cli.newChannel()
-	if err != nil {
-		return "", err
+	if cli.skipWrite("create block", "event_id", srcEvt.Id, "start", evt.Start.DateTime, "end", evt.End.DateTime, "rule", d.rule) {
+		entry := newAudit(actionCreated, srcEvt.Id, "")
+		entry.Rule = d.rule
+		return entry, nil
 	}
 
-	res, err := cli.svc.Events.Watch(cli.conf.SrcCalId, ch).Do()
+	// id given by client makes retry of insert safe. Calendar accepts lowercase hex as base32hex.
+	evt.Id = strings.ReplaceAll(uuid.New().String(), "-", "")
+	destEvt, err := cli.doEvent("insert", cli.svc.Events.Insert(cli.tenant.DestCalId, evt))
+	if isConflict(err) {
+		// inserted by previous attempt whose response was lost
+		destEvt, err = evt, nil
+	}
 	if err != nil {
-		return "", err
+		return store.AuditEntry{}, classify("create", err)
 	}
-	_, err = cli.fsCli.Collection("calendar").Doc("channel").Set(cli.ctx, map[string]interface{}{
-		"channelId":  ch.Id,
-		"resourceId": res.ResourceId,
-		"exp":        res.Expiration,
+	err = cli.store.SaveMapping(cli.ctx, cli.tenant.Id, store.Mapping{
+		SrcEventId:  srcEvt.Id,
+		DestEventId: destEvt.Id,
+		Created:     time.Now(),
+		End:         blockEnd(evt),
 	})
 	if err != nil {
-		return "", err
+		return store.AuditEntry{}, transient("save mapping", err)
 	}
-	return res.ResourceId, nil
+	metrics.Blocks.WithLabelValues(cli.tenant.Id, actionCreated).Inc()
+	entry := newAudit(actionCreated, srcEvt.Id, destEvt.Id)
+	entry.Rule = d.rule
+	return entry, nil
 }
 
-func (cli *Client) newChannel() (*calendar.Channel, error) {
-	id, err := uuid.NewRandom()
+// isCovered checks if an existing event on destination calendar already blocks time of evt
+func (cli *Client) isCovered(evt *calendar.Event) (covered bool, err error) {
+	ctx, span := tracing.Start(cli.ctx, "coverage")
+	defer func() {
+		span.SetAttributes(attribute.Bool("covered", covered))
+		tracing.End(span, err)
+	}()
+	cli = cli.WithContext(ctx)
+
+	events, err := cli.doEvents("list", cli.svc.Events.List(cli.tenant.DestCalId).TimeMin(evt.Start.DateTime).TimeMax(evt.End.DateTime))
 	if err != nil {
-		return nil, fmt.Errorf("get random uuid: %s", err)
+		return false, classify("list existing events", err)
 	}
-	// set expiration but forced to about 1 month later
-	exp, _ := time.Parse(gcalTimeFormat, "2030-01-01T00:00:00+09:00")
-	ch := calendar.Channel{
-		Id:         id.String(),
-		Type:       "webhook",
-		Expiration: exp.UnixNano() / int64(time.Millisecond),
-		Address:    cli.conf.Url,
+	span.SetAttributes(attribute.Int("existing", len(events.Items)))
+	start, _ := time.Parse(gcalTimeFormat, evt.Start.DateTime)
+	end, _ := time.Parse(gcalTimeFormat, evt.End.DateTime)
+	for _, existingEvent := range events.Items {
+		startExisting, _ := time.Parse(gcalTimeFormat, existingEvent.Start.DateTime)
+		endExisting, _ := time.Parse(gcalTimeFormat, existingEvent.End.DateTime)
+		// evtが既存の予定の時間帯に収まるなら作らない
+		if !start.Before(startExisting) && !end.After(endExisting) {
+			return true, nil
+		}
 	}
-	return &ch, nil
+	return false, nil
 }
 
-func (cli *Client) StopWatch(channelId string, resourceId string) (string, error) {
-	ch := calendar.Channel{
-		ResourceId: resourceId,
-		Id:         channelId,
-	}
-	err := cli.svc.Channels.Stop(&ch).Do()
-	if err != nil {
-		return "", err
-	}
-	log.Printf("stopped channel %s", channelId)
-	return channelId, nil
+const defaultOffset = 30
+
+// reasons why no block is made for source event
+const (
+	skipNotConfirmed = "not_confirmed"
+	skipAllDay       = "all_day"
+	skipWeekend      = "weekend"
+	skipOffHours     = "off_hours"
+	skipIgnored      = "ignored"
+	skipCovered      = "covered"
+)
+
+// ruleDefault is reported as rule of events matching no rule
+const ruleDefault = "default"
+
+// decision is how block is made for source event
+type decision struct {
+	evt  *calendar.Event // nil if skipped
+	skip string
+	rule string // match of the rule applied
+	// ruleLabel names the rule in metrics without revealing its match
+	ruleLabel string
 }
 
-func (cli *Client) RenewWatch() (string, error) {
-	ch, err := cli.newChannel()
-	if err != nil {
-		return "", err
+func (cli *Client) decide(srcEvt *calendar.Event) decision {
+	return cli.evaluate(srcEvt, nil)
+}
+
+// evaluate applies filters and rules to srcEvt, recording each step in ex if not nil
+func (cli *Client) evaluate(srcEvt *calendar.Event, ex *Explanation) (d decision) {
+	_, span := tracing.Start(cli.ctx, "rules", attribute.String("event_id", srcEvt.Id))
+	defer func() {
+		span.SetAttributes(attribute.String("rule", d.rule), attribute.String("skip", d.skip))
+		span.End()
+	}()
+
+	if srcEvt.Status != "confirmed" { // キャンセル等。作成済みイベントはreconcileBlockで削除
+		ex.step("status", false, "status is %q", srcEvt.Status)
+		return decision{skip: skipNotConfirmed}
 	}
-	res, err := cli.svc.Events.Watch(cli.conf.SrcCalId, ch).Do()
-	if err != nil {
-		return "", err
+	ex.step("status", true, "confirmed")
+	if srcEvt.Start == nil || srcEvt.Start.DateTime == "" { // 終日
+		ex.step("all_day", false, "all-day event")
+		return decision{skip: skipAllDay}
 	}
+	ex.step("all_day", true, "has start time")
 
-	// get stopping channel
-	snap, err := cli.fsCli.Collection("calendar").Doc("channel").Get(cli.ctx)
-	if err != nil {
-		return "", err
+	start, _ := time.Parse(gcalTimeFormat, srcEvt.Start.DateTime)
+	end, _ := time.Parse(gcalTimeFormat, srcEvt.End.DateTime)
+	// 週末開始か終了なら無視
+	if w := start.Weekday(); w == time.Saturday || w == time.Sunday {
+		ex.step("weekday", false, "starts on %s", w)
+		return decision{skip: skipWeekend}
+	} else if w := end.Weekday(); w == time.Saturday || w == time.Sunday {
+		ex.step("weekday", false, "ends on %s", w)
+		return decision{skip: skipWeekend}
 	}
-	m := snap.Data()
-	log.Println(m["channelId"].(string), m["resourceId"].(string))
-
-	// set new channel
-	_, err = cli.fsCli.Collection("calendar").Doc("channel").Set(cli.ctx, map[string]interface{}{
-		"channelId":  ch.Id,
-		"resourceId": res.ResourceId,
-		"exp":        res.Expiration,
-	})
-	if err != nil {
-		return "", err
+	ex.step("weekday", true, "%s to %s", start.Weekday(), end.Weekday())
+	if (start.Hour() >= 22) || (end.Hour() <= 9) {
+		ex.step("hours", false, "%s-%s starts at 22:00 or later, or ends before 10:00", start.Format("15:04"), end.Format("15:04"))
+		return decision{skip: skipOffHours}
 	}
+	ex.step("hours", true, "%s-%s", start.Format("15:04"), end.Format("15:04"))
 
-	// stop channel
-	stoppingCh := calendar.Channel{
-		ResourceId: m["resourceId"].(string),
-		Id:         m["channelId"].(string),
+	matched, label := "", ruleDefault
+	for i, rule := range cli.tenant.Rules {
+		if !rule.MatchString(srcEvt.Summary) {
+			ex.step("rule", false, "%q does not match", rule.Match)
+			continue
+		}
+		if rule.Ignore {
+			ex.step("rule", false, "%q matches and ignores the event", rule.Match)
+			return decision{skip: skipIgnored, rule: rule.Match, ruleLabel: rule.Label(i)}
+		}
+		ex.step("rule", true, "%q matches", rule.Match)
+		start = add(start, rule.StartOffset)
+		end = add(end, rule.EndOffset)
+		ex.step("offset", true, "start %+d min, end %+d min", rule.StartOffset, rule.EndOffset)
+		matched, label = rule.Match, rule.Label(i)
+		break
+	}
+	if matched == "" {
+		matched = ruleDefault
+		// Google Meetなどがない場合はデフォルト
+		if srcEvt.ConferenceData == nil || srcEvt.ConferenceData.ConferenceSolution == nil {
+			start = add(start, -defaultOffset)
+			end = add(end, defaultOffset)
+			ex.step("offset", true, "no rule matches and no conference, so start %+d min, end %+d min", -defaultOffset, defaultOffset)
+		} else {
+			ex.step("offset", true, "no rule matches but conference exists, so no offset")
+		}
 	}
-	if err := cli.svc.Channels.Stop(&stoppingCh).Do(); err != nil {
-		return "", err
+	return decision{
+		evt: &calendar.Event{
+			Summary: "ブロック",
+			Start: &calendar.EventDateTime{
+				DateTime: start.Format(gcalTimeFormat),
+			},
+			End: &calendar.EventDateTime{
+				DateTime: end.Format(gcalTimeFormat),
+			},
+		},
+		rule:      matched,
+		ruleLabel: label,
 	}
-	return "", nil
 }
 
 func add(t time.Time, offset int) time.Time {
@@ -0,0 +1,138 @@
+package calendar
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"google.golang.org/api/calendar/v3"
+	"google.golang.org/api/option"
+
+	"github.com/shiraily/gcal-sync/config"
+	"github.com/shiraily/gcal-sync/store"
+)
+
+// fakeList serves pages of events.list in order, recording pageToken of each request
+type fakeList struct {
+	mu         sync.Mutex
+	pages      []calendar.Events
+	pageTokens []string
+}
+
+func (f *fakeList) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.pageTokens = append(f.pageTokens, r.URL.Query().Get("pageToken"))
+	page := f.pages[0]
+	if len(f.pages) > 1 {
+		f.pages = f.pages[1:]
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(page)
+}
+
+func newTestClient(t *testing.T, f *fakeList) *Client {
+	t.Helper()
+	srv := httptest.NewServer(f)
+	t.Cleanup(srv.Close)
+	ctx := context.Background()
+	svc, err := calendar.NewService(ctx, option.WithEndpoint(srv.URL), option.WithHTTPClient(srv.Client()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &Client{
+		ctx:    ctx,
+		conf:   &config.Config{},
+		tenant: &config.Tenant{Id: config.DefaultTenantId, SrcCalId: "src", DestCalId: "dest"},
+		svc:    svc,
+		store:  store.NewMemoryStore(),
+	}
+}
+
+func TestSyncInitialPages(t *testing.T) {
+	f := &fakeList{pages: []calendar.Events{
+		{NextPageToken: "p2"},
+		{NextPageToken: "p3"},
+		{NextSyncToken: "token"},
+	}}
+	cli := newTestClient(t, f)
+	if err := cli.SyncInitial(); err != nil {
+		t.Fatal(err)
+	}
+	if token, _ := cli.readToken(); token != "token" {
+		t.Errorf("token: want token of the last page, got %q", token)
+	}
+	if got := f.pageTokens; len(got) != 3 || got[1] != "p2" || got[2] != "p3" {
+		t.Errorf("page tokens: %q", got)
+	}
+}
+
+func TestSyncSavesTokenOfLastPage(t *testing.T) {
+	f := &fakeList{pages: []calendar.Events{
+		{NextPageToken: "p2"},
+		{NextSyncToken: "new"},
+	}}
+	cli := newTestClient(t, f)
+	if err := cli.store.CompareAndSwapToken(cli.ctx, cli.tenant.Id, "", "old"); err != nil {
+		t.Fatal(err)
+	}
+	res, err := cli.sync()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if token, _ := cli.readToken(); token != "new" || res.tokenAfter != "new" {
+		t.Errorf("token: want new, got %q", token)
+	}
+}
+
+func TestSyncRefusesEmptyToken(t *testing.T) {
+	f := &fakeList{pages: []calendar.Events{{}}}
+	cli := newTestClient(t, f)
+	if err := cli.store.CompareAndSwapToken(cli.ctx, cli.tenant.Id, "", "old"); err != nil {
+		t.Fatal(err)
+	}
+	_, err := cli.sync()
+	if err == nil || IsTransient(err) {
+		t.Errorf("want permanent error, got %v", err)
+	}
+	if token, _ := cli.readToken(); token != "old" {
+		t.Errorf("token: want old kept, got %q", token)
+	}
+
+	cli = newTestClient(t, &fakeList{pages: []calendar.Events{{}}})
+	if err := cli.SyncInitial(); err == nil {
+		t.Error("want error of empty token on initial sync")
+	}
+	if token, _ := cli.readToken(); token != "" {
+		t.Errorf("token: want none, got %q", token)
+	}
+}
+
+func TestVerifyChannelWithoutToken(t *testing.T) {
+	cli := newTestClient(t, &fakeList{pages: []calendar.Events{{}}})
+	now := time.Now()
+	for _, ch := range []store.Channel{
+		{Id: "live", Expiration: now.Add(time.Hour).UnixNano() / int64(time.Millisecond), Created: now.Add(-time.Hour)},
+		{Id: "expired", Expiration: now.Add(-time.Minute).UnixNano() / int64(time.Millisecond), Created: now.Add(-time.Hour)},
+		{Id: "recent", Created: now.Add(-time.Hour)},
+		{Id: "old", Created: now.Add(-legacyChannelGrace - time.Minute)},
+		{Id: "unknown"},
+	} {
+		if err := cli.store.SaveChannel(cli.ctx, cli.tenant.Id, ch); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for id, ok := range map[string]bool{"live": true, "expired": false, "recent": true, "old": false, "unknown": false} {
+		err := cli.VerifyChannel(id, "")
+		if ok && err != nil {
+			t.Errorf("%s: want accepted, got %s", id, err)
+		}
+		if !ok && (err == nil || IsTransient(err)) {
+			t.Errorf("%s: want rejected, got %v", id, err)
+		}
+	}
+}
@@ -0,0 +1,427 @@
+package calendar
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"google.golang.org/api/calendar/v3"
+
+	"github.com/shiraily/gcal-sync/config"
+	"github.com/shiraily/gcal-sync/store"
+)
+
+const (
+	defaultRenewMargin    = 48 * time.Hour
+	defaultConfirmTimeout = 10 * time.Minute
+
+	// channelLockTTL keeps the channel manager of other instances out while changing channels
+	channelLockTTL  = 2 * time.Minute
+	channelLockWait = time.Minute
+
+	// legacyChannelGrace limits acceptance of a channel without token whose expiration is unknown
+	legacyChannelGrace = 7 * 24 * time.Hour
+
+	stopAttempts = 3
+	stopBackoff  = time.Second
+)
+
+// StartWatch adds a new channel. Existing channels are left to MaintainChannels.
+func (cli *Client) StartWatch() (string, error) {
+	ch, err := cli.startChannel()
+	if err != nil {
+		return "", err
+	}
+	return ch.ResourceId, nil
+}
+
+func (cli *Client) startChannel() (*store.Channel, error) {
+	ch, err := cli.newChannel()
+	if err != nil {
+		return nil, err
+	}
+	if cli.skipWrite("start channel", "channel_id", ch.Id, "address", ch.Address) {
+		return &store.Channel{Id: ch.Id, Created: time.Now()}, nil
+	}
+
+	// save before watching since handshake of the channel may arrive before Watch returns
+	saved := store.Channel{Id: ch.Id, Token: ch.Token, Created: time.Now()}
+	if err := cli.store.SaveChannel(cli.ctx, cli.tenant.Id, saved); err != nil {
+		return nil, err
+	}
+	res, err := cli.doChannel("watch", cli.svc.Events.Watch(cli.tenant.SrcCalId, ch))
+	if err != nil {
+		cli.rollbackChannel(saved)
+		return nil, classify("watch", err)
+	}
+	// Google caps expiration, so saves the real one. Only these fields are written since
+	// handshake may have confirmed the channel in the meantime.
+	saved.ResourceId = res.ResourceId
+	saved.Expiration = res.Expiration
+	if err := cli.store.SetChannelWatch(cli.ctx, cli.tenant.Id, saved.Id, saved.ResourceId, saved.Expiration); err != nil {
+		// channel unknown to store would only be rejected
+		cli.rollbackChannel(saved)
+		return nil, err
+	}
+	cli.logger().Info("started channel", "channel_id", saved.Id, "expires", saved.ExpiresAt())
+	return &saved, nil
+}
+
+// rollbackChannel undoes channel failed to start. Failure is only logged since the channel manager
+// cleans up channels never confirmed.
+func (cli *Client) rollbackChannel(ch store.Channel) {
+	if err := cli.stopChannelWithRetry(ch); err != nil {
+		cli.logger().Error("roll back channel", "channel_id", ch.Id, "error", err)
+	}
+}
+
+func (cli *Client) newChannel() (*calendar.Channel, error) {
+	id, err := uuid.NewRandom()
+	if err != nil {
+		return nil, fmt.Errorf("get random uuid: %s", err)
+	}
+	token := make([]byte, 32)
+	if _, err := rand.Read(token); err != nil {
+		return nil, fmt.Errorf("get random token: %s", err)
+	}
+	ch := calendar.Channel{
+		Id:      id.String(),
+		Type:    "webhook",
+		Address: cli.channelAddress(),
+		Token:   hex.EncodeToString(token),
+	}
+	// Google's default lifetime if not set
+	if ttl := cli.conf.Channel.TTL; ttl > 0 {
+		ch.Expiration = time.Now().Add(ttl).UnixNano() / int64(time.Millisecond)
+	}
+	return &ch, nil
+}
+
+// channelAddress is webhook url. Notifications of other than the default tenant are routed by tenant parameter.
+func (cli *Client) channelAddress() string {
+	if cli.tenant.Id == config.DefaultTenantId {
+		return cli.conf.Url
+	}
+	u, err := url.Parse(cli.conf.Url)
+	if err != nil {
+		return cli.conf.Url
+	}
+	q := u.Query()
+	q.Set("tenant", cli.tenant.Id)
+	u.RawQuery = q.Encode()
+	return u.String()
+}
+
+// VerifyChannel checks that notification comes from one of the active channels.
+// Rejected notification is a permanent error, and failure to read channels is transient.
+func (cli *Client) VerifyChannel(channelId string, token string) error {
+	channels, err := cli.store.ListChannels(cli.ctx, cli.tenant.Id)
+	if err != nil {
+		return transient("list channels", err)
+	}
+	for _, ch := range channels {
+		if ch.Id != channelId {
+			continue
+		}
+		// channels created before tokens were introduced are accepted until they expire,
+		// not to lose notifications until the channel manager replaces them
+		if ch.Token == "" {
+			deadline := legacyDeadline(ch)
+			if !time.Now().Before(deadline) {
+				return permanent("verify channel", fmt.Errorf("channel %s without token expired at %s", channelId, deadline))
+			}
+			cli.logger().Warn("accept channel without token until renewed", "channel_id", channelId, "deadline", deadline)
+			return nil
+		}
+		if subtle.ConstantTimeCompare([]byte(token), []byte(ch.Token)) != 1 {
+			return permanent("verify channel", fmt.Errorf("invalid token of channel %s", channelId))
+		}
+		return nil
+	}
+	return permanent("verify channel", fmt.Errorf("unknown channel %s", channelId))
+}
+
+// legacyDeadline is when a channel without token stops being accepted: its expiration, or
+// legacyChannelGrace after it was created when expiration is unknown
+func legacyDeadline(ch store.Channel) time.Time {
+	if exp := ch.ExpiresAt(); !exp.IsZero() {
+		return exp
+	}
+	if ch.Created.IsZero() {
+		return time.Time{}
+	}
+	return ch.Created.Add(legacyChannelGrace)
+}
+
+// ConfirmChannel records that handshake of the channel arrived
+func (cli *Client) ConfirmChannel(channelId string) error {
+	if cli.skipWrite("confirm channel", "channel_id", channelId) {
+		return nil
+	}
+	// only Confirmed is written, not to overwrite resource id and expiration saved after Watch
+	err := cli.store.ConfirmChannel(cli.ctx, cli.tenant.Id, channelId)
+	if errors.Is(err, store.ErrUnknownChannel) {
+		return fmt.Errorf("unknown channel %s", channelId)
+	}
+	return err
+}
+
+// stopWatch only stops notifications of the channel. Use stopChannel to forget it too.
+func (cli *Client) stopWatch(channelId string, resourceId string) (string, error) {
+	ch := calendar.Channel{
+		ResourceId: resourceId,
+		Id:         channelId,
+	}
+	if cli.skipWrite("stop channel", "channel_id", channelId, "resource_id", resourceId) {
+		return channelId, nil
+	}
+	err := cli.do("stop", cli.svc.Channels.Stop(&ch))
+	if err != nil {
+		return "", err
+	}
+	cli.logger().Info("stopped channel", "channel_id", channelId)
+	return channelId, nil
+}
+
+// StopChannel stops channel and deletes it from state store, in the same way as the channel manager.
+// resourceId may be empty for channel saved in state store.
+func (cli *Client) StopChannel(channelId string, resourceId string) error {
+	unlock, err := cli.lock(cli.ctx, "channels:"+cli.tenant.Id, uuid.New().String(), channelLockTTL, channelLockWait)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	channels, err := cli.store.ListChannels(cli.ctx, cli.tenant.Id)
+	if err != nil {
+		return err
+	}
+	ch := store.Channel{Id: channelId}
+	for _, c := range channels {
+		if c.Id == channelId {
+			ch = c
+		}
+	}
+	if resourceId != "" {
+		ch.ResourceId = resourceId
+	}
+	if ch.ResourceId == "" {
+		return fmt.Errorf("resource id of channel %s is unknown", channelId)
+	}
+	return cli.stopChannel(ch)
+}
+
+// stopChannel stops channel and forgets it. Channel already gone is not an error.
+func (cli *Client) stopChannel(ch store.Channel) error {
+	// watching has failed if no resource id
+	if ch.ResourceId != "" {
+		_, err := cli.stopWatch(ch.Id, ch.ResourceId)
+		if isGone(err) {
+			cli.logger().Info("channel is already gone", "channel_id", ch.Id)
+		} else if err != nil {
+			return err
+		}
+	}
+	if cli.skipWrite("forget channel", "channel_id", ch.Id) {
+		return nil
+	}
+	return cli.store.DeleteChannel(cli.ctx, cli.tenant.Id, ch.Id)
+}
+
+// stopChannelWithRetry retries stopping since channel left running keeps sending notifications
+func (cli *Client) stopChannelWithRetry(ch store.Channel) error {
+	var err error
+	for i := 0; i < stopAttempts; i++ {
+		if i > 0 {
+			time.Sleep(stopBackoff << (i - 1))
+		}
+		if err = cli.stopChannel(ch); err == nil {
+			return nil
+		}
+		cli.logger().Warn("stop channel", "channel_id", ch.Id, "attempt", i+1, "error", err)
+	}
+	return err
+}
+
+// RenewWatch starts a new channel and stops the others. The new channel is kept even if stopping
+// old ones fails, and they are left to the channel manager.
+func (cli *Client) RenewWatch() (string, error) {
+	unlock, err := cli.lock(cli.ctx, "channels:"+cli.tenant.Id, uuid.New().String(), channelLockTTL, channelLockWait)
+	if err != nil {
+		return "", err
+	}
+	defer unlock()
+
+	old, err := cli.store.ListChannels(cli.ctx, cli.tenant.Id)
+	if err != nil {
+		return "", err
+	}
+	ch, err := cli.startChannel()
+	if err != nil {
+		// old channels are untouched
+		return "", err
+	}
+	var failed []string
+	for _, o := range old {
+		cli.logger().Info("stop channel replaced", "channel_id", o.Id, "new_channel_id", ch.Id)
+		if err := cli.stopChannelWithRetry(o); err != nil {
+			failed = append(failed, o.Id)
+		}
+	}
+	if len(failed) > 0 {
+		return ch.Id, fmt.Errorf("started %s but failed to stop %s", ch.Id, strings.Join(failed, ", "))
+	}
+	return ch.Id, nil
+}
+
+// Channels returns channels saved in state store, including ones not confirmed yet
+func (cli *Client) Channels() ([]store.Channel, error) {
+	return cli.store.ListChannels(cli.ctx, cli.tenant.Id)
+}
+
+// ActiveChannel returns the confirmed channel living longest, or nil if none is confirmed
+func (cli *Client) ActiveChannel() (*store.Channel, error) {
+	channels, err := cli.store.ListChannels(cli.ctx, cli.tenant.Id)
+	if err != nil {
+		return nil, err
+	}
+	return activeOf(channels), nil
+}
+
+func activeOf(channels []store.Channel) *store.Channel {
+	var active *store.Channel
+	for i, ch := range channels {
+		if !ch.Confirmed {
+			continue
+		}
+		// unknown expiration is treated as living longest
+		if active == nil || ch.Expiration == 0 || (active.Expiration != 0 && ch.Expiration > active.Expiration) {
+			active = &channels[i]
+		}
+	}
+	return active
+}
+
+// CheckChannel fails if no confirmed channel exists, or the active one expires within half of
+// renew margin, which means channel manager has failed to renew it
+func (cli *Client) CheckChannel() error {
+	ch, err := cli.ActiveChannel()
+	if err != nil {
+		return err
+	}
+	return cli.CheckActive(ch)
+}
+
+// CheckActive is CheckChannel for the active channel already read
+func (cli *Client) CheckActive(ch *store.Channel) error {
+	if ch == nil {
+		return errors.New("no confirmed channel")
+	}
+	if ch.Expiration == 0 {
+		return nil
+	}
+	margin := cli.conf.Channel.RenewMargin
+	if margin <= 0 {
+		margin = defaultRenewMargin
+	}
+	left := time.Until(ch.ExpiresAt())
+	if left <= 0 {
+		return fmt.Errorf("channel %s expired at %s", ch.Id, ch.ExpiresAt().Format(time.RFC3339))
+	}
+	if left < margin/2 {
+		return fmt.Errorf("channel %s expires at %s", ch.Id, ch.ExpiresAt().Format(time.RFC3339))
+	}
+	return nil
+}
+
+// MaintainChannels keeps one confirmed channel alive. It starts a new channel a margin before
+// the current one expires, stops old channels once the new one is confirmed, and cleans up
+// channels expired or never confirmed. It is run by timer or scheduler.
+func (cli *Client) MaintainChannels() error {
+	margin := cli.conf.Channel.RenewMargin
+	if margin <= 0 {
+		margin = defaultRenewMargin
+	}
+	confirmTimeout := cli.conf.Channel.ConfirmTimeout
+	if confirmTimeout <= 0 {
+		confirmTimeout = defaultConfirmTimeout
+	}
+
+	unlock, err := cli.lock(cli.ctx, "channels:"+cli.tenant.Id, uuid.New().String(), channelLockTTL, channelLockWait)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	channels, err := cli.store.ListChannels(cli.ctx, cli.tenant.Id)
+	if err != nil {
+		return err
+	}
+	now := time.Now()
+	var live []store.Channel
+	for _, ch := range channels {
+		switch {
+		case !ch.ExpiresAt().IsZero() && now.After(ch.ExpiresAt()):
+			cli.logger().Info("forget expired channel", "channel_id", ch.Id)
+			if cli.skipWrite("forget channel", "channel_id", ch.Id) {
+				continue
+			}
+			if err := cli.store.DeleteChannel(cli.ctx, cli.tenant.Id, ch.Id); err != nil {
+				return err
+			}
+		case !ch.Confirmed && !ch.Created.IsZero() && now.Sub(ch.Created) > confirmTimeout:
+			cli.logger().Warn("stop channel never confirmed", "channel_id", ch.Id)
+			if err := cli.stopChannelWithRetry(ch); err != nil {
+				return err
+			}
+		default:
+			live = append(live, ch)
+		}
+	}
+
+	// current is the confirmed channel living longest
+	var current *store.Channel
+	pending := false
+	for i, ch := range live {
+		if !ch.Confirmed {
+			pending = true
+			continue
+		}
+		if !ch.ExpiresAt().IsZero() && ch.ExpiresAt().Before(now.Add(margin)) {
+			continue
+		}
+		// channel without token is replaced as soon as possible, since its notifications are not verified
+		if ch.Token == "" {
+			continue
+		}
+		if current == nil || ch.Expiration > current.Expiration {
+			current = &live[i]
+		}
+	}
+	if current == nil {
+		if pending {
+			cli.logger().Info("waiting for confirmation of new channel")
+			return nil
+		}
+		_, err := cli.startChannel()
+		return err
+	}
+
+	// old channels overlap until new one is confirmed
+	for _, ch := range live {
+		if ch.Id == current.Id || !ch.Confirmed {
+			continue
+		}
+		cli.logger().Info("stop channel superseded", "channel_id", ch.Id, "new_channel_id", current.Id)
+		if err := cli.stopChannelWithRetry(ch); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,23 @@
+package calendar
+
+// WithDryRun returns copy of the client which only logs writes to calendars and state store,
+// in addition to dry_run of env.yaml
+func (cli *Client) WithDryRun(dryRun bool) *Client {
+	c := *cli
+	c.dryRun = dryRun
+	return &c
+}
+
+// DryRun reports whether writes are skipped
+func (cli *Client) DryRun() bool {
+	return cli.dryRun || cli.conf.DryRun
+}
+
+// skipWrite logs the write instead of doing it in dry run, and reports whether it is skipped
+func (cli *Client) skipWrite(msg string, kv ...interface{}) bool {
+	if !cli.DryRun() {
+		return false
+	}
+	cli.logger().With("dry_run", true).Info("would "+msg, kv...)
+	return true
+}
@@ -0,0 +1,110 @@
+package calendar
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+
+	"google.golang.org/api/googleapi"
+
+	"github.com/shiraily/gcal-sync/retry"
+)
+
+// Error tells whether failed operation may succeed by retrying it later
+type Error struct {
+	Op        string
+	Err       error
+	Transient bool
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("%s: %s", e.Op, e.Err)
+}
+
+func (e *Error) Unwrap() error {
+	return e.Err
+}
+
+// Temporary is checked by queue not to retry permanent errors
+func (e *Error) Temporary() bool {
+	return e.Transient
+}
+
+// IsTransient reports whether err may succeed by retrying. Unknown errors are treated as transient.
+func IsTransient(err error) bool {
+	var e *Error
+	if errors.As(err, &e) {
+		return e.Transient
+	}
+	return err != nil
+}
+
+func transient(op string, err error) error {
+	return &Error{Op: op, Err: err, Transient: true}
+}
+
+func permanent(op string, err error) error {
+	return &Error{Op: op, Err: err}
+}
+
+// classify wraps err of Calendar API by its status. Rate limits and server errors are transient,
+// and other client errors such as invalid request or missing permission are permanent.
+func classify(op string, err error) error {
+	if err == nil {
+		return nil
+	}
+	var e *Error
+	if errors.As(err, &e) {
+		return err
+	}
+	var gerr *googleapi.Error
+	if errors.As(err, &gerr) {
+		switch {
+		case gerr.Code == http.StatusTooManyRequests || gerr.Code >= 500:
+			return transient(op, err)
+		case gerr.Code == http.StatusForbidden && retry.IsRateLimited(gerr):
+			return transient(op, err)
+		case gerr.Code >= 400:
+			return permanent(op, err)
+		}
+	}
+	// network errors and timeouts
+	return transient(op, err)
+}
+
+// ItemError is failure of one source event, which does not stop sync of others
+type ItemError struct {
+	EventId string
+	Err     error
+}
+
+func (e *ItemError) Error() string {
+	return fmt.Sprintf("event %s: %s", e.EventId, e.Err)
+}
+
+func (e *ItemError) Unwrap() error {
+	return e.Err
+}
+
+// SyncError collects failures of events in one sync.
+// It is transient if any of them is, since the whole changes are synced again.
+type SyncError struct {
+	Items []*ItemError
+}
+
+func (e *SyncError) Error() string {
+	msg := fmt.Sprintf("%d events failed", len(e.Items))
+	if len(e.Items) > 0 {
+		msg += ", first: " + e.Items[0].Error()
+	}
+	return msg
+}
+
+func (e *SyncError) Temporary() bool {
+	for _, item := range e.Items {
+		if IsTransient(item.Err) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,112 @@
+package calendar
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+
+	"google.golang.org/api/calendar/v3"
+)
+
+// Explanation is the decision path of a source event, which tells why it was or was not blocked
+type Explanation struct {
+	EventId string `json:"eventId"`
+	Summary string `json:"summary"`
+	Steps   []Step `json:"steps"`
+	// Blocked is whether a block would be created
+	Blocked bool   `json:"blocked"`
+	Rule    string `json:"rule,omitempty"`
+	Skip    string `json:"skip,omitempty"`
+	Start   string `json:"start,omitempty"`
+	End     string `json:"end,omitempty"`
+}
+
+// Step is one check of the decision. Passed is false if the check skips the event or the rule does not apply.
+type Step struct {
+	Check  string `json:"check"`
+	Passed bool   `json:"passed"`
+	Detail string `json:"detail"`
+}
+
+// step does nothing on nil, so that sync does not pay for recording
+func (ex *Explanation) step(check string, passed bool, format string, args ...interface{}) {
+	if ex == nil {
+		return
+	}
+	ex.Steps = append(ex.Steps, Step{Check: check, Passed: passed, Detail: fmt.Sprintf(format, args...)})
+}
+
+// Write prints the explanation for humans
+func (ex *Explanation) Write(w io.Writer) error {
+	if _, err := fmt.Fprintf(w, "event %s %q\n", ex.EventId, ex.Summary); err != nil {
+		return err
+	}
+	for _, s := range ex.Steps {
+		mark := "ok"
+		if !s.Passed {
+			mark = "--"
+		}
+		if _, err := fmt.Fprintf(w, "  [%s] %-8s %s\n", mark, s.Check, s.Detail); err != nil {
+			return err
+		}
+	}
+	var err error
+	if ex.Blocked {
+		_, err = fmt.Fprintf(w, "=> block %s - %s by rule %q\n", ex.Start, ex.End, ex.Rule)
+	} else {
+		_, err = fmt.Fprintf(w, "=> not blocked: %s\n", ex.Skip)
+	}
+	return err
+}
+
+// Explain traces how srcEvt is decided. Coverage by existing events on destination calendar
+// is checked only if coverage is set, since it calls Calendar API.
+func (cli *Client) Explain(srcEvt *calendar.Event, coverage bool) (*Explanation, error) {
+	ex := &Explanation{EventId: srcEvt.Id, Summary: srcEvt.Summary}
+	d := cli.evaluate(srcEvt, ex)
+	ex.Rule, ex.Skip = d.rule, d.skip
+	if d.evt == nil {
+		return ex, nil
+	}
+	ex.Start, ex.End = d.evt.Start.DateTime, d.evt.End.DateTime
+	if coverage {
+		covered, err := cli.isCovered(d.evt)
+		if err != nil {
+			return nil, err
+		}
+		if covered {
+			ex.step("coverage", false, "existing event on destination calendar covers %s - %s", ex.Start, ex.End)
+			ex.Skip = skipCovered
+			return ex, nil
+		}
+		ex.step("coverage", true, "no existing event covers %s - %s", ex.Start, ex.End)
+	}
+	ex.Blocked = true
+	return ex, nil
+}
+
+// GetSourceEvent reads the event on source calendar
+func (cli *Client) GetSourceEvent(eventId string) (*calendar.Event, error) {
+	evt, err := cli.doEvent("get", cli.svc.Events.Get(cli.tenant.SrcCalId, eventId))
+	if err != nil {
+		return nil, classify("get source event "+eventId, err)
+	}
+	return evt, nil
+}
+
+// ReadEventFixture reads event in JSON of Calendar API
+func ReadEventFixture(path string) (*calendar.Event, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var evt calendar.Event
+	if err := json.Unmarshal(b, &evt); err != nil {
+		return nil, fmt.Errorf("parse %s: %s", path, err)
+	}
+	if evt.Start == nil || evt.End == nil {
+		return nil, fmt.Errorf("%s: start and end are required", path)
+	}
+	return &evt, nil
+}
@@ -0,0 +1,64 @@
+package calendar
+
+import (
+	"github.com/shiraily/gcal-sync/logging"
+	"github.com/shiraily/gcal-sync/store"
+)
+
+const defaultHistoryLimit = 20
+
+// History answers why a block is on the calendar: actions taken for the event and runs taking them
+type History struct {
+	Runs  []store.Run        `json:"runs"`
+	Audit []store.AuditEntry `json:"audit"`
+}
+
+// HistoryQuery selects history. Recent runs and actions are returned if no event nor block is given.
+type HistoryQuery struct {
+	SrcEventId  string
+	DestEventId string
+	Limit       int
+}
+
+// History returns actions matching q, newest first. Sync tokens are redacted.
+func (cli *Client) History(q HistoryQuery) (*History, error) {
+	limit := q.Limit
+	if limit <= 0 {
+		limit = defaultHistoryLimit
+	}
+	audit, err := cli.store.ListAudit(cli.ctx, cli.tenant.Id, store.AuditQuery{
+		SrcEventId:  q.SrcEventId,
+		DestEventId: q.DestEventId,
+		Limit:       limit,
+	})
+	if err != nil {
+		return nil, err
+	}
+	h := &History{Audit: audit}
+	if q.SrcEventId == "" && q.DestEventId == "" {
+		if h.Runs, err = cli.store.ListRuns(cli.ctx, cli.tenant.Id, limit); err != nil {
+			return nil, err
+		}
+	} else {
+		// only runs which took the actions
+		seen := map[string]bool{}
+		for _, e := range audit {
+			if e.RunId == "" || seen[e.RunId] {
+				continue
+			}
+			seen[e.RunId] = true
+			r, err := cli.store.ReadRun(cli.ctx, cli.tenant.Id, e.RunId)
+			if err != nil {
+				return nil, err
+			}
+			if r != nil {
+				h.Runs = append(h.Runs, *r)
+			}
+		}
+	}
+	for i := range h.Runs {
+		h.Runs[i].TokenBefore = logging.Secret(h.Runs[i].TokenBefore)
+		h.Runs[i].TokenAfter = logging.Secret(h.Runs[i].TokenAfter)
+	}
+	return h, nil
+}
@@ -0,0 +1,75 @@
+package calendar
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+)
+
+const (
+	syncLockTTL  = 5 * time.Minute
+	syncLockWait = 2 * time.Minute
+	// lockPollInterval is interval to retry taking lock held by another instance
+	lockPollInterval = time.Second
+)
+
+// gate coalesces syncs of the same calendar in this process.
+// While a sync is running, later calls only leave one follow-up run.
+type gate struct {
+	mu      sync.Mutex
+	running map[string]bool
+	pending map[string]bool
+}
+
+var syncGate = &gate{running: map[string]bool{}, pending: map[string]bool{}}
+
+// enter returns false if a sync of key is running. Then the running one syncs again after it finishes.
+func (g *gate) enter(key string) bool {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if g.running[key] {
+		g.pending[key] = true
+		return false
+	}
+	g.running[key] = true
+	return true
+}
+
+// next returns true if another sync was requested while running. Otherwise leaves the gate.
+func (g *gate) next(key string) bool {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if g.pending[key] {
+		delete(g.pending, key)
+		return true
+	}
+	delete(g.running, key)
+	return false
+}
+
+// lock waits for the lock shared by all instances, and returns function to release it
+func (cli *Client) lock(ctx context.Context, name string, owner string, ttl time.Duration, wait time.Duration) (func(), error) {
+	deadline := time.Now().Add(wait)
+	for {
+		ok, err := cli.store.AcquireLock(ctx, name, owner, ttl)
+		if err != nil {
+			return nil, err
+		}
+		if ok {
+			return func() {
+				if err := cli.store.ReleaseLock(ctx, name, owner); err != nil {
+					cli.logger().Warn("release lock", "lock", name, "error", err)
+				}
+			}, nil
+		}
+		if time.Now().After(deadline) {
+			return nil, fmt.Errorf("lock %s is held by another instance", name)
+		}
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(lockPollInterval):
+		}
+	}
+}
@@ -0,0 +1,212 @@
+package calendar
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"reflect"
+	"sync"
+	"time"
+
+	"golang.org/x/oauth2/google"
+	"google.golang.org/api/calendar/v3"
+
+	"github.com/shiraily/gcal-sync/config"
+	"github.com/shiraily/gcal-sync/logging"
+	"github.com/shiraily/gcal-sync/store"
+)
+
+const oldStoreCloseDelay = 5 * time.Minute
+
+// Pool keeps Calendar services and state store built at startup, and hands out cheap clients
+// for each request. It is safe for concurrent use.
+type Pool struct {
+	ctx  context.Context
+	path string
+
+	mu    sync.RWMutex
+	conf  *config.Config
+	store store.StateStore
+	// svcs are keyed by credentials file, shared by tenants using the same key
+	svcs   map[string]*calendar.Service
+	hooks  []func(conf *config.Config)
+	dryRun bool
+}
+
+// NewPool loads config and credentials of all tenants, so that broken ones fail at startup
+func NewPool(ctx context.Context, path string) (*Pool, error) {
+	conf, err := config.Load(path)
+	if err != nil {
+		return nil, err
+	}
+	if err := conf.Validate(); err != nil {
+		return nil, fmt.Errorf("%s: %s", path, err)
+	}
+	p := &Pool{ctx: ctx, path: path}
+	svcs, err := p.newServices(conf, nil)
+	if err != nil {
+		return nil, err
+	}
+	st, err := store.Open(ctx, conf, serviceAccountClientSecret)
+	if err != nil {
+		return nil, fmt.Errorf("open state store: %s", err)
+	}
+	p.conf, p.svcs, p.store = conf, svcs, st
+	return p, nil
+}
+
+// newServices builds services for credentials of tenants, reusing ones in old
+func (p *Pool) newServices(conf *config.Config, old map[string]*calendar.Service) (map[string]*calendar.Service, error) {
+	svcs := map[string]*calendar.Service{}
+	for _, t := range conf.GetTenants() {
+		credentials := credentialsOf(&t)
+		if _, ok := svcs[credentials]; ok {
+			continue
+		}
+		if svc, ok := old[credentials]; ok {
+			svcs[credentials] = svc
+			continue
+		}
+		svc, err := NewCalendarServiceWithServiceAccount(p.ctx, credentials)
+		if err != nil {
+			return nil, fmt.Errorf("calendar service of %s: %s", t.Id, err)
+		}
+		svcs[credentials] = svc
+	}
+	return svcs, nil
+}
+
+func credentialsOf(tenant *config.Tenant) string {
+	if tenant.Credentials != "" {
+		return tenant.Credentials
+	}
+	return serviceAccountClientSecret
+}
+
+// Client returns client of the tenant. Empty id means the default tenant.
+// Closing it is not needed.
+func (p *Pool) Client(tenantId string) (*Client, error) {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	tenant, err := p.conf.GetTenant(tenantId)
+	if err != nil {
+		return nil, err
+	}
+	return &Client{
+		ctx:      p.ctx,
+		conf:     p.conf,
+		tenant:   tenant,
+		svc:      p.svcs[credentialsOf(tenant)],
+		store:    p.store,
+		isPooled: true,
+		dryRun:   p.dryRun,
+	}, nil
+}
+
+// SetDryRun makes clients only log writes, in addition to dry_run of env.yaml
+func (p *Pool) SetDryRun(dryRun bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.dryRun = dryRun
+}
+
+func (p *Pool) Config() *config.Config {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	return p.conf
+}
+
+func (p *Pool) Store() store.StateStore {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	return p.store
+}
+
+// OnReload registers hook called with new config after reloading
+func (p *Pool) OnReload(hook func(conf *config.Config)) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.hooks = append(p.hooks, hook)
+}
+
+// Reload reads config again. Current config is kept if new one is broken.
+// Clients already handed out keep using old services until they finish.
+func (p *Pool) Reload() error {
+	conf, err := config.Load(p.path)
+	if err != nil {
+		return err
+	}
+	if err := conf.Validate(); err != nil {
+		return fmt.Errorf("%s: %s", p.path, err)
+	}
+	p.mu.RLock()
+	old, oldConf := p.svcs, p.conf
+	p.mu.RUnlock()
+	svcs, err := p.newServices(conf, old)
+	if err != nil {
+		return err
+	}
+	var st store.StateStore
+	if !reflect.DeepEqual(conf.Store, oldConf.Store) || conf.Project != oldConf.Project {
+		if st, err = store.Open(p.ctx, conf, serviceAccountClientSecret); err != nil {
+			return fmt.Errorf("open state store: %s", err)
+		}
+	}
+
+	p.mu.Lock()
+	p.conf, p.svcs = conf, svcs
+	var oldStore store.StateStore
+	if st != nil {
+		oldStore, p.store = p.store, st
+	}
+	hooks := append([]func(*config.Config){}, p.hooks...)
+	p.mu.Unlock()
+
+	if oldStore != nil {
+		// requests using old store may be running
+		time.AfterFunc(oldStoreCloseDelay, func() {
+			if err := oldStore.Close(); err != nil {
+				logging.Error("close old store", "error", err)
+			}
+		})
+	}
+	for _, hook := range hooks {
+		hook(conf)
+	}
+	logging.Info("reloaded config", "path", p.path)
+	return nil
+}
+
+// CheckCredentials reads key files of all tenants again, which may have been rotated or removed
+func (p *Pool) CheckCredentials() error {
+	p.mu.RLock()
+	conf := p.conf
+	p.mu.RUnlock()
+	checked := map[string]bool{}
+	for _, t := range conf.GetTenants() {
+		credentials := credentialsOf(&t)
+		if checked[credentials] {
+			continue
+		}
+		checked[credentials] = true
+		b, err := ioutil.ReadFile(credentials)
+		if err != nil {
+			return fmt.Errorf("credentials of %s: %s", t.Id, err)
+		}
+		if _, err := google.CredentialsFromJSON(p.ctx, b, calendar.CalendarScope); err != nil {
+			return fmt.Errorf("credentials of %s: %s", t.Id, err)
+		}
+	}
+	return nil
+}
+
+// Path is the config file loaded
+func (p *Pool) Path() string {
+	return p.path
+}
+
+func (p *Pool) Close() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.store.Close()
+}
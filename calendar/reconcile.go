@@ -0,0 +1,195 @@
+package calendar
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"google.golang.org/api/calendar/v3"
+	"google.golang.org/api/googleapi"
+
+	"github.com/shiraily/gcal-sync/metrics"
+	"github.com/shiraily/gcal-sync/store"
+)
+
+// actions taken for source events, recorded in audit
+const (
+	actionCreated = "created"
+	actionSkipped = "skipped"
+	actionKept    = "kept"
+	actionPatched = "patched"
+	actionDeleted = "deleted"
+	// actionForgotten means block was deleted by user, so only the mapping is removed
+	actionForgotten = "forgotten"
+)
+
+const defaultReconcileMaxDeletes = 10
+
+// Reconcile fixes blocks of future events whose source event changed or was cancelled without being synced,
+// such as when notification was lost or rules were changed. It returns number of blocks fixed.
+// Source events not found are reported as error instead of deleting their blocks, since it may be
+// caused by wrong config such as calendar id, and deletes are capped by schedule.reconcile_max_deletes.
+func (cli *Client) Reconcile() (int, error) {
+	// sync patching the same blocks in the meantime would be undone by stale reads of reconcile
+	unlock, err := cli.lock(cli.ctx, "sync:"+cli.syncKey(), uuid.New().String(), syncLockTTL, syncLockWait)
+	if err != nil {
+		return 0, err
+	}
+	defer unlock()
+
+	mappings, err := cli.store.ListMappings(cli.ctx, cli.tenant.Id)
+	if err != nil {
+		return 0, err
+	}
+	maxDeletes := cli.conf.Schedule.ReconcileMaxDeletes
+	if maxDeletes <= 0 {
+		maxDeletes = defaultReconcileMaxDeletes
+	}
+	now := time.Now()
+	fixed, deleted := 0, 0
+	var missing []string
+	var audit []store.AuditEntry
+	defer func() {
+		if cli.DryRun() {
+			return
+		}
+		// entries of reconcile have no run
+		if err := cli.store.SaveAudit(cli.ctx, cli.tenant.Id, audit); err != nil {
+			cli.logger().Error("save audit", "error", err)
+		}
+	}()
+	for _, m := range mappings {
+		if m.IsPast(now) {
+			continue
+		}
+		srcEvt, err := cli.doEvent("get", cli.svc.Events.Get(cli.tenant.SrcCalId, m.SrcEventId))
+		if isGone(err) {
+			cli.logger().Warn("source event not found", "event_id", m.SrcEventId, "block_id", m.DestEventId)
+			missing = append(missing, m.SrcEventId)
+			continue
+		} else if err != nil {
+			return fixed, classify("get source event "+m.SrcEventId, err)
+		}
+		if cli.decide(srcEvt).evt == nil {
+			if deleted >= maxDeletes {
+				return fixed, permanent("reconcile", fmt.Errorf("stopped after deleting %d blocks", deleted))
+			}
+			deleted++
+		}
+		entry, err := cli.reconcileBlock(m, srcEvt)
+		if err != nil {
+			return fixed, err
+		}
+		metrics.Blocks.WithLabelValues(cli.tenant.Id, entry.Action).Inc()
+		if entry.Action != actionKept {
+			cli.logger().Info("block reconciled", "action", entry.Action, "block_id", m.DestEventId, "event_id", m.SrcEventId)
+			audit = append(audit, entry)
+			fixed++
+		}
+	}
+	if len(missing) > 0 {
+		return fixed, permanent("reconcile", fmt.Errorf("%d source events not found: %s",
+			len(missing), strings.Join(missing, ", ")))
+	}
+	return fixed, nil
+}
+
+// reconcileBlock makes block already created for srcEvt follow its change.
+// It returns audit entry of the action taken.
+func (cli *Client) reconcileBlock(m store.Mapping, srcEvt *calendar.Event) (store.AuditEntry, error) {
+	d := cli.decide(srcEvt)
+	want := d.evt
+	if want == nil {
+		if cli.skipWrite("delete block", "block_id", m.DestEventId, "event_id", m.SrcEventId, "reason", d.skip) {
+			entry := newAudit(actionDeleted, m.SrcEventId, m.DestEventId)
+			entry.Rule, entry.Reason = d.rule, d.skip
+			return entry, nil
+		}
+		err := cli.do("delete", cli.svc.Events.Delete(cli.tenant.DestCalId, m.DestEventId))
+		if err != nil && !isGone(err) {
+			return store.AuditEntry{}, classify("delete block "+m.DestEventId, err)
+		}
+		entry := newAudit(actionDeleted, m.SrcEventId, m.DestEventId)
+		entry.Rule, entry.Reason = d.rule, d.skip
+		return entry, cli.store.DeleteMapping(cli.ctx, cli.tenant.Id, m.SrcEventId)
+	}
+
+	destEvt, err := cli.doEvent("get", cli.svc.Events.Get(cli.tenant.DestCalId, m.DestEventId))
+	if isGone(err) || (err == nil && destEvt.Status == "cancelled") {
+		entry := newAudit(actionForgotten, m.SrcEventId, m.DestEventId)
+		entry.Rule, entry.Reason = d.rule, "block removed"
+		if cli.skipWrite("forget block", "block_id", m.DestEventId, "event_id", m.SrcEventId) {
+			return entry, nil
+		}
+		return entry, cli.store.DeleteMapping(cli.ctx, cli.tenant.Id, m.SrcEventId)
+	} else if err != nil {
+		return store.AuditEntry{}, classify("get block "+m.DestEventId, err)
+	}
+	if destEvt.Start != nil && destEvt.End != nil &&
+		sameTime(destEvt.Start.DateTime, want.Start.DateTime) && sameTime(destEvt.End.DateTime, want.End.DateTime) {
+		return newAudit(actionKept, m.SrcEventId, m.DestEventId), cli.saveEnd(m, want)
+	}
+	patch := &calendar.Event{Start: want.Start, End: want.End}
+	if cli.skipWrite("patch block", "block_id", m.DestEventId, "event_id", m.SrcEventId,
+		"start", want.Start.DateTime, "end", want.End.DateTime) {
+		entry := newAudit(actionPatched, m.SrcEventId, m.DestEventId)
+		entry.Rule = d.rule
+		return entry, nil
+	}
+	if _, err := cli.doEvent("patch", cli.svc.Events.Patch(cli.tenant.DestCalId, m.DestEventId, patch)); err != nil {
+		return store.AuditEntry{}, classify("patch block "+m.DestEventId, err)
+	}
+	entry := newAudit(actionPatched, m.SrcEventId, m.DestEventId)
+	entry.Rule = d.rule
+	return entry, cli.saveEnd(m, want)
+}
+
+// saveEnd records end of block in the mapping, which is missing in mappings saved by older versions
+func (cli *Client) saveEnd(m store.Mapping, block *calendar.Event) error {
+	end := blockEnd(block)
+	if end.IsZero() || end.Equal(m.End) || cli.DryRun() {
+		return nil
+	}
+	m.End = end
+	if err := cli.store.SaveMapping(cli.ctx, cli.tenant.Id, m); err != nil {
+		return transient("save mapping", err)
+	}
+	return nil
+}
+
+// blockEnd is zero if end of the block is unknown
+func blockEnd(block *calendar.Event) time.Time {
+	if block.End == nil {
+		return time.Time{}
+	}
+	t, err := time.Parse(time.RFC3339, block.End.DateTime)
+	if err != nil {
+		return time.Time{}
+	}
+	return t
+}
+
+// sameTime compares date times which may be in different time zones
+func sameTime(a, b string) bool {
+	ta, errA := time.Parse(time.RFC3339, a)
+	tb, errB := time.Parse(time.RFC3339, b)
+	if errA != nil || errB != nil {
+		return a == b
+	}
+	return ta.Equal(tb)
+}
+
+// isGone means event or channel does not exist
+func isGone(err error) bool {
+	var gerr *googleapi.Error
+	return errors.As(err, &gerr) && (gerr.Code == http.StatusNotFound || gerr.Code == http.StatusGone)
+}
+
+// isConflict means event of the id already exists
+func isConflict(err error) bool {
+	var gerr *googleapi.Error
+	return errors.As(err, &gerr) && gerr.Code == http.StatusConflict
+}
@@ -0,0 +1,61 @@
+package calendar
+
+import (
+	"time"
+)
+
+// Report summarizes syncs in a period
+type Report struct {
+	TenantId string
+	Since    time.Time
+	Runs     int
+	Failed   int
+	Created  int
+	// FailedEvents counts events failed in runs, including ones synced by retry later
+	FailedEvents int
+	LastError    string
+}
+
+const reportMaxRuns = 1000
+
+func (cli *Client) Report(since time.Time) (*Report, error) {
+	runs, err := cli.store.ListRuns(cli.ctx, cli.tenant.Id, reportMaxRuns)
+	if err != nil {
+		return nil, err
+	}
+	r := &Report{TenantId: cli.tenant.Id, Since: since}
+	// runs are newest first
+	for _, run := range runs {
+		if run.Started.Before(since) {
+			break
+		}
+		r.Runs++
+		r.Created += run.Created
+		r.FailedEvents += len(run.Failures)
+		if run.Error != "" {
+			if r.Failed == 0 {
+				r.LastError = run.Error
+			}
+			r.Failed++
+		}
+	}
+	return r, nil
+}
+
+// Cleanup deletes history of syncs started before t, and mappings of blocks ended before t
+// which reconcile no longer looks at. It returns number of runs deleted.
+func (cli *Client) Cleanup(before time.Time) (int, error) {
+	if cli.skipWrite("delete runs and mappings", "before", before.Format(time.RFC3339)) {
+		return 0, nil
+	}
+	n, err := cli.store.DeleteRunsBefore(cli.ctx, cli.tenant.Id, before)
+	if err != nil {
+		return n, err
+	}
+	pruned, err := cli.store.DeleteMappingsBefore(cli.ctx, cli.tenant.Id, before)
+	if err != nil {
+		return n, err
+	}
+	cli.logger().Info("deleted mappings", "deleted", pruned)
+	return n, nil
+}
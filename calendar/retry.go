@@ -0,0 +1,93 @@
+package calendar
+
+import (
+	"errors"
+	"strconv"
+
+	"go.opentelemetry.io/otel/attribute"
+	"google.golang.org/api/calendar/v3"
+	"google.golang.org/api/googleapi"
+
+	"github.com/shiraily/gcal-sync/metrics"
+	"github.com/shiraily/gcal-sync/retry"
+	"github.com/shiraily/gcal-sync/tracing"
+)
+
+// calls of Calendar API, which can be run again for retry
+
+type eventsCall interface {
+	Do(opts ...googleapi.CallOption) (*calendar.Events, error)
+}
+
+type eventCall interface {
+	Do(opts ...googleapi.CallOption) (*calendar.Event, error)
+}
+
+type channelCall interface {
+	Do(opts ...googleapi.CallOption) (*calendar.Channel, error)
+}
+
+type noResultCall interface {
+	Do(opts ...googleapi.CallOption) error
+}
+
+// retry runs f with retry policy of the operation set in env.yaml
+func (cli *Client) retry(op string, f func() error) (err error) {
+	_, span := tracing.Start(cli.ctx, "calendar."+op)
+	attempts := 0
+	defer func() {
+		span.SetAttributes(attribute.Int("attempts", attempts))
+		tracing.End(span, err)
+	}()
+	return retry.For(cli.conf.Retry, op).Do(cli.ctx, func() error {
+		attempts++
+		err := f()
+		if err != nil {
+			metrics.APIErrors.WithLabelValues(op, errorCode(err)).Inc()
+		}
+		return err
+	})
+}
+
+// errorCode is HTTP status of failed call, or "network" if no response
+func errorCode(err error) string {
+	var gerr *googleapi.Error
+	if errors.As(err, &gerr) {
+		return strconv.Itoa(gerr.Code)
+	}
+	var rerr *retry.RetryAfterError
+	if errors.As(err, &rerr) {
+		return strconv.Itoa(rerr.StatusCode)
+	}
+	return "network"
+}
+
+func (cli *Client) doEvents(op string, call eventsCall) (events *calendar.Events, err error) {
+	err = cli.retry(op, func() error {
+		events, err = call.Do()
+		return err
+	})
+	return events, err
+}
+
+func (cli *Client) doEvent(op string, call eventCall) (evt *calendar.Event, err error) {
+	err = cli.retry(op, func() error {
+		evt, err = call.Do()
+		return err
+	})
+	return evt, err
+}
+
+func (cli *Client) doChannel(op string, call channelCall) (ch *calendar.Channel, err error) {
+	err = cli.retry(op, func() error {
+		ch, err = call.Do()
+		return err
+	})
+	return ch, err
+}
+
+func (cli *Client) do(op string, call noResultCall) error {
+	return cli.retry(op, func() error {
+		return call.Do()
+	})
+}
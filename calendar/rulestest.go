@@ -0,0 +1,130 @@
+package calendar
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+
+	"google.golang.org/api/calendar/v3"
+	"gopkg.in/yaml.v2"
+
+	"github.com/shiraily/gcal-sync/config"
+)
+
+// RuleCase is a sample event with expected outcome of rules
+type RuleCase struct {
+	Name   string       `yaml:"name"`
+	Event  CaseEvent    `yaml:"event"`
+	Expect CaseExpected `yaml:"expect"`
+}
+
+// CaseEvent is the part of source event evaluated by rules
+type CaseEvent struct {
+	Summary string `yaml:"summary"`
+	Status  string `yaml:"status,omitempty"` // default confirmed
+	Start   string `yaml:"start"`            // RFC 3339, or date if all-day
+	End     string `yaml:"end"`
+	AllDay  bool   `yaml:"all_day,omitempty"`
+	// Conference means the event has Google Meet or another conference
+	Conference bool `yaml:"conference,omitempty"`
+}
+
+// CaseExpected is outcome of rules. Empty fields are not checked.
+type CaseExpected struct {
+	Blocked *bool  `yaml:"blocked,omitempty"`
+	Start   string `yaml:"start,omitempty"`
+	End     string `yaml:"end,omitempty"`
+	Summary string `yaml:"summary,omitempty"`
+	Rule    string `yaml:"rule,omitempty"`
+	Skip    string `yaml:"skip,omitempty"`
+}
+
+// RuleResult is result of a case. Failures is empty if passed.
+type RuleResult struct {
+	Name     string
+	Failures []string
+}
+
+func (r RuleResult) Passed() bool {
+	return len(r.Failures) == 0
+}
+
+// ReadRuleCases reads cases in YAML or JSON
+func ReadRuleCases(path string) ([]RuleCase, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var cases []RuleCase
+	if err := yaml.UnmarshalStrict(b, &cases); err != nil {
+		return nil, fmt.Errorf("parse %s: %s", path, err)
+	}
+	return cases, nil
+}
+
+// EvaluateRuleCases runs cases through rules of the tenant, in the same way as sync except coverage check.
+// No credentials nor state store is needed.
+func EvaluateRuleCases(ctx context.Context, tenant *config.Tenant, cases []RuleCase) []RuleResult {
+	cli := &Client{ctx: ctx, tenant: tenant}
+	var results []RuleResult
+	for i, c := range cases {
+		name := c.Name
+		if name == "" {
+			name = fmt.Sprintf("case %d", i+1)
+		}
+		d := cli.decide(c.Event.toEvent())
+		results = append(results, RuleResult{Name: name, Failures: c.Expect.check(d)})
+	}
+	return results
+}
+
+func (e CaseEvent) toEvent() *calendar.Event {
+	evt := &calendar.Event{
+		Id:      "fixture",
+		Summary: e.Summary,
+		Status:  e.Status,
+		Start:   &calendar.EventDateTime{DateTime: e.Start},
+		End:     &calendar.EventDateTime{DateTime: e.End},
+	}
+	if evt.Status == "" {
+		evt.Status = "confirmed"
+	}
+	if e.AllDay {
+		evt.Start = &calendar.EventDateTime{Date: e.Start}
+		evt.End = &calendar.EventDateTime{Date: e.End}
+	}
+	if e.Conference {
+		evt.ConferenceData = &calendar.ConferenceData{ConferenceSolution: &calendar.ConferenceSolution{Name: "Google Meet"}}
+	}
+	return evt
+}
+
+func (x CaseExpected) check(d decision) []string {
+	var failures []string
+	blocked := d.evt != nil
+	if x.Blocked != nil && *x.Blocked != blocked {
+		failures = append(failures, fmt.Sprintf("blocked: want %t, got %t (skip %q)", *x.Blocked, blocked, d.skip))
+	}
+	if x.Rule != "" && x.Rule != d.rule {
+		failures = append(failures, fmt.Sprintf("rule: want %q, got %q", x.Rule, d.rule))
+	}
+	if x.Skip != "" && x.Skip != d.skip {
+		failures = append(failures, fmt.Sprintf("skip: want %q, got %q", x.Skip, d.skip))
+	}
+	if !blocked {
+		if x.Start != "" || x.End != "" || x.Summary != "" {
+			failures = append(failures, "not blocked, so start, end and summary cannot be checked")
+		}
+		return failures
+	}
+	if x.Start != "" && !sameTime(x.Start, d.evt.Start.DateTime) {
+		failures = append(failures, fmt.Sprintf("start: want %s, got %s", x.Start, d.evt.Start.DateTime))
+	}
+	if x.End != "" && !sameTime(x.End, d.evt.End.DateTime) {
+		failures = append(failures, fmt.Sprintf("end: want %s, got %s", x.End, d.evt.End.DateTime))
+	}
+	if x.Summary != "" && x.Summary != d.evt.Summary {
+		failures = append(failures, fmt.Sprintf("summary: want %q, got %q", x.Summary, d.evt.Summary))
+	}
+	return failures
+}
@@ -0,0 +1,61 @@
+package calendar
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/shiraily/gcal-sync/config"
+)
+
+func sampleTenant(t *testing.T) *config.Tenant {
+	t.Helper()
+	conf, err := config.Load("../sample.env.yaml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := conf.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	tenant, err := conf.GetTenant("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tenant
+}
+
+// TestSampleRules keeps sample fixtures passing with rules of sample config
+func TestSampleRules(t *testing.T) {
+	cases, err := ReadRuleCases("../sample.rules_test.yaml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(cases) == 0 {
+		t.Fatal("no cases")
+	}
+	for _, r := range EvaluateRuleCases(context.Background(), sampleTenant(t), cases) {
+		if !r.Passed() {
+			t.Errorf("%s:\n  %s", r.Name, strings.Join(r.Failures, "\n  "))
+		}
+	}
+}
+
+func TestEvaluateRuleCasesReportsFailures(t *testing.T) {
+	blocked := true
+	cases := []RuleCase{{
+		Name: "weekend",
+		Event: CaseEvent{
+			Summary: "病院",
+			Start:   "2021-08-07T10:00:00+09:00",
+			End:     "2021-08-07T11:00:00+09:00",
+		},
+		Expect: CaseExpected{Blocked: &blocked, Rule: "病院"},
+	}}
+	results := EvaluateRuleCases(context.Background(), sampleTenant(t), cases)
+	if len(results) != 1 {
+		t.Fatalf("want 1 result, got %d", len(results))
+	}
+	if r := results[0]; r.Passed() || len(r.Failures) != 2 {
+		t.Errorf("want failures of blocked and rule, got %q", r.Failures)
+	}
+}
@@ -2,12 +2,29 @@ package calendar
 
 import (
 	"context"
+	"fmt"
+	"io/ioutil"
+	"net/http"
 
+	"golang.org/x/oauth2"
+	"golang.org/x/oauth2/google"
 	"google.golang.org/api/calendar/v3"
 	"google.golang.org/api/option"
+
+	"github.com/shiraily/gcal-sync/retry"
 )
 
 // サービスアカウントのみを用いる場合。APIコール時にはアクセス対象のカレンダーIDが必要
 func NewCalendarServiceWithServiceAccount(ctx context.Context, credentialFile string) (*calendar.Service, error) {
-	return calendar.NewService(ctx, option.WithCredentialsFile(credentialFile))
+	b, err := ioutil.ReadFile(credentialFile)
+	if err != nil {
+		return nil, fmt.Errorf("read service account key: %s", err)
+	}
+	creds, err := google.CredentialsFromJSON(ctx, b, calendar.CalendarScope)
+	if err != nil {
+		return nil, fmt.Errorf("parse service account key: %s", err)
+	}
+	// Retry-After is lost in error of API calls without retry.Transport
+	cli := &http.Client{Transport: &oauth2.Transport{Source: creds.TokenSource, Base: &retry.Transport{}}}
+	return calendar.NewService(ctx, option.WithHTTPClient(cli))
 }
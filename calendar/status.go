@@ -0,0 +1,148 @@
+package calendar
+
+import (
+	"time"
+
+	"github.com/shiraily/gcal-sync/store"
+)
+
+// statusHorizon is how far blocks are counted by Status
+const statusHorizon = 30 * 24 * time.Hour
+
+// Status is state of the tenant kept in state store and calendars
+type Status struct {
+	TenantId string          `json:"tenant"`
+	Channels []ChannelStatus `json:"channels"`
+	HasToken bool            `json:"hasToken"`
+	LastRun  *RunStatus      `json:"lastRun,omitempty"`
+	// Blocks is number of blocks created by gcal-sync in the next 30 days
+	Blocks int `json:"blocks"`
+	// RetryingJobs is number of jobs waiting for retry, only known by server with in-process queue
+	RetryingJobs *int `json:"retryingJobs,omitempty"`
+	// ChannelProblem tells why notifications may not arrive, such as no confirmed channel or one
+	// expiring soon because channel manager failed. Empty in polling mode.
+	ChannelProblem string `json:"channelProblem,omitempty"`
+}
+
+type ChannelStatus struct {
+	Id         string `json:"id"`
+	ResourceId string `json:"resourceId"`
+	Confirmed  bool   `json:"confirmed"`
+	Active     bool   `json:"active"`
+	// Expiration and ExpiresIn are omitted if expiration is unknown
+	Expiration *time.Time `json:"expiration,omitempty"`
+	ExpiresIn  string     `json:"expiresIn,omitempty"`
+}
+
+type RunStatus struct {
+	Id       string    `json:"id"`
+	Started  time.Time `json:"started"`
+	Finished time.Time `json:"finished"`
+	Trigger  string    `json:"trigger"`
+	Result   string    `json:"result"` // ok or error
+	Error    string    `json:"error,omitempty"`
+	Failures int       `json:"failures"`
+	// RetryPending means transient failures, whose changes are synced again on retry
+	RetryPending bool `json:"retryPending"`
+}
+
+// Status reads channels, token and the last run, and counts blocks on destination calendar
+func (cli *Client) Status() (*Status, error) {
+	st := &Status{TenantId: cli.tenant.Id, Channels: []ChannelStatus{}}
+	channels, err := cli.Channels()
+	if err != nil {
+		return nil, err
+	}
+	active := activeOf(channels)
+	if cli.conf.Mode != "poll" {
+		if err := cli.CheckActive(active); err != nil {
+			st.ChannelProblem = err.Error()
+		}
+	}
+	for _, ch := range channels {
+		cs := ChannelStatus{
+			Id:         ch.Id,
+			ResourceId: ch.ResourceId,
+			Confirmed:  ch.Confirmed,
+			Active:     active != nil && active.Id == ch.Id,
+		}
+		if exp := ch.ExpiresAt(); !exp.IsZero() {
+			cs.Expiration = &exp
+			cs.ExpiresIn = time.Until(exp).Round(time.Minute).String()
+		}
+		st.Channels = append(st.Channels, cs)
+	}
+
+	token, err := cli.readToken()
+	if err != nil {
+		return nil, err
+	}
+	st.HasToken = token != ""
+
+	runs, err := cli.store.ListRuns(cli.ctx, cli.tenant.Id, 1)
+	if err != nil {
+		return nil, err
+	}
+	if len(runs) > 0 {
+		st.LastRun = newRunStatus(runs[0])
+	}
+
+	if st.Blocks, err = cli.countBlocks(time.Now(), time.Now().Add(statusHorizon)); err != nil {
+		return nil, err
+	}
+	return st, nil
+}
+
+func newRunStatus(r store.Run) *RunStatus {
+	rs := &RunStatus{
+		Id:       r.Id,
+		Started:  r.Started,
+		Finished: r.Finished,
+		Trigger:  r.Trigger,
+		Result:   "ok",
+		Error:    r.Error,
+		Failures: len(r.Failures),
+	}
+	if r.Error != "" {
+		rs.Result = "error"
+	}
+	for _, f := range r.Failures {
+		if f.Transient {
+			rs.RetryPending = true
+		}
+	}
+	return rs
+}
+
+// countBlocks counts events on destination calendar between min and max which have mappings
+func (cli *Client) countBlocks(min, max time.Time) (int, error) {
+	mappings, err := cli.store.ListMappings(cli.ctx, cli.tenant.Id)
+	if err != nil {
+		return 0, err
+	}
+	if len(mappings) == 0 {
+		return 0, nil
+	}
+	owned := map[string]bool{}
+	for _, m := range mappings {
+		owned[m.DestEventId] = true
+	}
+	call := cli.svc.Events.List(cli.tenant.DestCalId).ShowDeleted(false).SingleEvents(true).
+		TimeMin(min.Format(time.RFC3339)).TimeMax(max.Format(time.RFC3339))
+	n := 0
+	for {
+		events, err := cli.doEvents("list", call)
+		if err != nil {
+			return 0, classify("list blocks", err)
+		}
+		for _, evt := range events.Items {
+			if owned[evt.Id] {
+				n++
+			}
+		}
+		if events.NextPageToken == "" {
+			return n, nil
+		}
+		call = call.PageToken(events.NextPageToken)
+	}
+}
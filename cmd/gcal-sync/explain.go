@@ -0,0 +1,47 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+
+	gcal "google.golang.org/api/calendar/v3"
+
+	"github.com/shiraily/gcal-sync/calendar"
+)
+
+func runExplain(g *globals, args []string) error {
+	fs, tenantId := tenantFlags("explain")
+	eventId := fs.String("event", "", "id of source event")
+	fixture := fs.String("fixture", "", "JSON file of event, used instead of -event")
+	coverage := fs.Bool("coverage", true, "check existing events on destination calendar")
+	asJSON := fs.Bool("json", false, "print in JSON")
+	fs.Parse(args)
+	if fs.NArg() != 0 || (*eventId == "") == (*fixture == "") {
+		return errUsage
+	}
+
+	cli, closePool, err := g.client(*tenantId)
+	if err != nil {
+		return err
+	}
+	defer closePool()
+	var evt *gcal.Event
+	if *fixture != "" {
+		evt, err = calendar.ReadEventFixture(*fixture)
+	} else {
+		evt, err = cli.GetSourceEvent(*eventId)
+	}
+	if err != nil {
+		return err
+	}
+	ex, err := cli.Explain(evt, *coverage)
+	if err != nil {
+		return err
+	}
+	if *asJSON {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		return enc.Encode(ex)
+	}
+	return ex.Write(os.Stdout)
+}
@@ -0,0 +1,45 @@
+package main
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/shiraily/gcal-sync/calendar"
+)
+
+func runHistory(g *globals, args []string) error {
+	fs, tenantId := tenantFlags("history")
+	event := fs.String("event", "", "id of source event")
+	block := fs.String("block", "", "id of block on destination calendar")
+	limit := fs.Int("limit", 20, "max number of runs and actions")
+	fs.Parse(args)
+	if fs.NArg() != 0 {
+		return errUsage
+	}
+
+	cli, closePool, err := g.client(*tenantId)
+	if err != nil {
+		return err
+	}
+	defer closePool()
+	h, err := cli.History(calendar.HistoryQuery{SrcEventId: *event, DestEventId: *block, Limit: *limit})
+	if err != nil {
+		return err
+	}
+
+	fmt.Println("Actions:")
+	for _, e := range h.Audit {
+		fmt.Printf("%s %-9s event=%s block=%s rule=%q reason=%q run=%s\n",
+			e.Time.Format(time.RFC3339), e.Action, e.SrcEventId, e.DestEventId, e.Rule, e.Reason, e.RunId)
+	}
+	fmt.Println("Runs:")
+	for _, r := range h.Runs {
+		fmt.Printf("%s %s trigger=%s seen=%d created=%d failures=%d token=%s->%s",
+			r.Started.Format(time.RFC3339), r.Id, r.Trigger, r.Seen, r.Created, len(r.Failures), r.TokenBefore, r.TokenAfter)
+		if r.Error != "" {
+			fmt.Printf(" error=%q", r.Error)
+		}
+		fmt.Println()
+	}
+	return nil
+}
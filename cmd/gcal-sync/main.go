@@ -0,0 +1,134 @@
+// Command gcal-sync runs the webhook server and operations on calendars, channels and rules.
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/shiraily/gcal-sync/calendar"
+	"github.com/shiraily/gcal-sync/logging"
+)
+
+// globals are flags given before subcommand
+type globals struct {
+	configPath string
+	profile    string
+	dryRun     bool
+}
+
+// path is config file. Profile chooses env.<profile>.yaml unless the path is given.
+func (g *globals) path() string {
+	switch {
+	case g.configPath != "":
+		return g.configPath
+	case g.profile != "":
+		return "env." + g.profile + ".yaml"
+	}
+	return "env.yaml"
+}
+
+// pool loads config and credentials, and configures logs as the server does
+func (g *globals) pool() (*calendar.Pool, error) {
+	p, err := calendar.NewPool(context.Background(), g.path())
+	if err != nil {
+		return nil, err
+	}
+	if err := logging.Configure(p.Config().Log); err != nil {
+		return nil, err
+	}
+	p.SetDryRun(g.dryRun)
+	return p, nil
+}
+
+// client of the tenant. Empty id means the default tenant.
+func (g *globals) client(tenantId string) (*calendar.Client, func(), error) {
+	p, err := g.pool()
+	if err != nil {
+		return nil, nil, err
+	}
+	cli, err := p.Client(tenantId)
+	if err != nil {
+		p.Close()
+		return nil, nil, err
+	}
+	return cli, func() { p.Close() }, nil
+}
+
+type command struct {
+	name    string
+	args    string
+	summary string
+	run     func(g *globals, args []string) error
+}
+
+var commands = []command{
+	{"serve", "serve", "run the webhook server", runServe},
+	{"watch", "watch start|stop|renew|list [-tenant id] [-force] [channel-id [resource-id]]", "manage channels", runWatch},
+	{"sync", "sync [-tenant id]", "sync changes after the saved token", runSync},
+	{"resync", "resync [-tenant id]", "sync all upcoming events and get a new token", runResync},
+	{"reconcile", "reconcile [-tenant id]", "fix blocks whose source event changed without sync", runReconcile},
+	{"status", "status [-tenant id] [-json]", "show channels, token, last run and blocks", runStatus},
+	{"history", "history [-tenant id] [-event id] [-block id] [-limit n]", "show runs and actions, such as why a block exists", runHistory},
+	{"explain", "explain [-tenant id] [-coverage=false] [-json] -event id|-fixture event.json", "show how rules decide an event", runExplain},
+	{"token", "token src|dest", "get OAuth token of calendar", runToken},
+	{"rules", "rules test [-tenant id] fixtures.yaml", "test rules with event fixtures", runRules},
+	{"config", "config validate", "validate config file", runConfig},
+}
+
+// errUsage makes main print usage of the command
+var errUsage = errors.New("invalid arguments")
+
+func main() {
+	g := &globals{}
+	fs := flag.NewFlagSet("gcal-sync", flag.ExitOnError)
+	fs.StringVar(&g.configPath, "config", "", "config file. default env.yaml")
+	fs.StringVar(&g.profile, "profile", "", "use env.<profile>.yaml as config file, such as dev or prod")
+	fs.BoolVar(&g.dryRun, "dry-run", false, "only log writes to calendars and state store")
+	fs.Usage = func() { usage(fs) }
+	fs.Parse(os.Args[1:])
+
+	args := fs.Args()
+	if len(args) == 0 {
+		fs.Usage()
+		os.Exit(2)
+	}
+	for _, c := range commands {
+		if c.name != args[0] {
+			continue
+		}
+		err := c.run(g, args[1:])
+		if err == errUsage {
+			fmt.Fprintf(os.Stderr, "Usage: gcal-sync [flags] %s\n", c.args)
+			os.Exit(2)
+		} else if err != nil {
+			fmt.Fprintf(os.Stderr, "gcal-sync %s: %s\n", c.name, err)
+			os.Exit(1)
+		}
+		return
+	}
+	fmt.Fprintf(os.Stderr, "unknown command: %s\n", args[0])
+	fs.Usage()
+	os.Exit(2)
+}
+
+func usage(fs *flag.FlagSet) {
+	var b strings.Builder
+	b.WriteString("Usage: gcal-sync [flags] command [args]\n\nCommands:\n")
+	for _, c := range commands {
+		fmt.Fprintf(&b, "  %-10s %s\n", c.name, c.summary)
+	}
+	b.WriteString("\nFlags:\n")
+	fmt.Fprint(os.Stderr, b.String())
+	fs.PrintDefaults()
+}
+
+// tenantFlags returns flag set of a subcommand with -tenant
+func tenantFlags(name string) (*flag.FlagSet, *string) {
+	fs := flag.NewFlagSet(name, flag.ExitOnError)
+	tenantId := fs.String("tenant", "", "tenant id. default tenant if empty")
+	return fs, tenantId
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/shiraily/gcal-sync/calendar"
+	"github.com/shiraily/gcal-sync/config"
+)
+
+// runRules runs fixtures of events through rules in config, such as in CI of config repository.
+// No credentials are needed.
+func runRules(g *globals, args []string) error {
+	if len(args) == 0 || args[0] != "test" {
+		return errUsage
+	}
+	fs, tenantId := tenantFlags("rules test")
+	fs.Parse(args[1:])
+	if fs.NArg() != 1 {
+		return errUsage
+	}
+
+	conf, err := config.Load(g.path())
+	if err != nil {
+		return err
+	}
+	if err := conf.Validate(); err != nil {
+		return fmt.Errorf("%s: %s", g.path(), err)
+	}
+	tenant, err := conf.GetTenant(*tenantId)
+	if err != nil {
+		return err
+	}
+	cases, err := calendar.ReadRuleCases(fs.Arg(0))
+	if err != nil {
+		return err
+	}
+	failed := 0
+	for _, r := range calendar.EvaluateRuleCases(context.Background(), tenant, cases) {
+		if r.Passed() {
+			fmt.Printf("PASS %s\n", r.Name)
+			continue
+		}
+		failed++
+		fmt.Printf("FAIL %s\n  %s\n", r.Name, strings.Join(r.Failures, "\n  "))
+	}
+	fmt.Printf("%d passed, %d failed\n", len(cases)-failed, failed)
+	if failed > 0 {
+		return fmt.Errorf("%d cases failed", failed)
+	}
+	return nil
+}
+
+func runConfig(g *globals, args []string) error {
+	if len(args) != 1 || args[0] != "validate" {
+		return errUsage
+	}
+	conf, err := config.Load(g.path())
+	if err != nil {
+		return err
+	}
+	if err := conf.Validate(); err != nil {
+		return fmt.Errorf("%s: %s", g.path(), err)
+	}
+	fmt.Printf("%s is valid\n", g.path())
+	return nil
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"time"
+)
+
+func runStatus(g *globals, args []string) error {
+	fs, tenantId := tenantFlags("status")
+	asJSON := fs.Bool("json", false, "print in JSON")
+	fs.Parse(args)
+	if fs.NArg() != 0 {
+		return errUsage
+	}
+	cli, closePool, err := g.client(*tenantId)
+	if err != nil {
+		return err
+	}
+	defer closePool()
+	st, err := cli.Status()
+	if err != nil {
+		return err
+	}
+	if *asJSON {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		return enc.Encode(st)
+	}
+
+	fmt.Printf("Tenant: %s\n", st.TenantId)
+	if len(st.Channels) == 0 {
+		fmt.Println("Channels: none")
+	}
+	for _, ch := range st.Channels {
+		expires := "unknown"
+		if ch.Expiration != nil {
+			expires = fmt.Sprintf("%s (in %s)", ch.Expiration.Format(time.RFC3339), ch.ExpiresIn)
+		}
+		fmt.Printf("Channel: %s resource=%s confirmed=%t active=%t expires=%s\n",
+			ch.Id, ch.ResourceId, ch.Confirmed, ch.Active, expires)
+	}
+	if st.ChannelProblem != "" {
+		fmt.Printf("Channel problem: %s\n", st.ChannelProblem)
+	}
+	token := "missing"
+	if st.HasToken {
+		token = "present"
+	}
+	fmt.Printf("Sync token: %s\n", token)
+	if r := st.LastRun; r == nil {
+		fmt.Println("Last run: none")
+	} else {
+		fmt.Printf("Last run: %s trigger=%s result=%s failures=%d retry_pending=%t\n",
+			r.Started.Format(time.RFC3339), r.Trigger, r.Result, r.Failures, r.RetryPending)
+		if r.Error != "" {
+			fmt.Printf("  error: %s\n", r.Error)
+		}
+	}
+	fmt.Printf("Blocks in next 30 days: %d\n", st.Blocks)
+	return nil
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/shiraily/gcal-sync/calendar"
+)
+
+func runSync(g *globals, args []string) error {
+	return withClient(g, "sync", args, func(cli *calendar.Client) error {
+		n, err := cli.SyncChanges()
+		if err != nil {
+			return err
+		}
+		fmt.Printf("Synced %d changed events\n", n)
+		return nil
+	})
+}
+
+func runResync(g *globals, args []string) error {
+	return withClient(g, "resync", args, func(cli *calendar.Client) error {
+		n, err := cli.Resync()
+		if err != nil {
+			return err
+		}
+		fmt.Printf("Resynced %d upcoming events\n", n)
+		return nil
+	})
+}
+
+func runReconcile(g *globals, args []string) error {
+	return withClient(g, "reconcile", args, func(cli *calendar.Client) error {
+		n, err := cli.Reconcile()
+		if err != nil {
+			return err
+		}
+		fmt.Printf("Fixed %d blocks\n", n)
+		return nil
+	})
+}
+
+// withClient runs f with client of -tenant, for commands taking no other arguments
+func withClient(g *globals, name string, args []string, f func(cli *calendar.Client) error) error {
+	fs, tenantId := tenantFlags(name)
+	fs.Parse(args)
+	if fs.NArg() != 0 {
+		return errUsage
+	}
+	cli, closePool, err := g.client(*tenantId)
+	if err != nil {
+		return err
+	}
+	defer closePool()
+	return f(cli.WithTrigger(calendar.TriggerManual))
+}
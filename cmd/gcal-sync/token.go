@@ -2,16 +2,14 @@ package main
 
 import (
 	"context"
-	"flag"
 	"fmt"
 	"io/ioutil"
-	"log"
 	"net/http"
 	"time"
 
 	"golang.org/x/oauth2"
 	"golang.org/x/oauth2/google"
-	"google.golang.org/api/calendar/v3"
+	gcal "google.golang.org/api/calendar/v3"
 	"google.golang.org/api/option"
 
 	oauthToken "github.com/shiraily/gcal-sync/oauth"
@@ -31,36 +29,35 @@ func getClient(config *oauth2.Config, filePrefix string) *http.Client {
 	return config.Client(context.Background(), tok)
 }
 
-func main() {
-	flag.Parse()
-	args := flag.Args()
+// runToken gets OAuth token saved in <prefix>_token.json, and lists upcoming events to check it
+func runToken(g *globals, args []string) error {
 	if len(args) != 1 {
-		return
+		return errUsage
 	}
 	filePrefix := args[0]
 	ctx := context.Background()
 	b, err := ioutil.ReadFile("credentials.json")
 	if err != nil {
-		log.Fatalf("Unable to read client secret file: %v", err)
+		return fmt.Errorf("unable to read client secret file: %v", err)
 	}
 
 	// If modifying these scopes, delete your previously saved token.json.
 	config, err := google.ConfigFromJSON(b, "https://www.googleapis.com/auth/calendar.events.owned")
 	if err != nil {
-		log.Fatalf("Unable to parse client secret file to config: %v", err)
+		return fmt.Errorf("unable to parse client secret file to config: %v", err)
 	}
 	client := getClient(config, filePrefix)
 
-	srv, err := calendar.NewService(ctx, option.WithHTTPClient(client))
+	srv, err := gcal.NewService(ctx, option.WithHTTPClient(client))
 	if err != nil {
-		log.Fatalf("Unable to retrieve Calendar client: %v", err)
+		return fmt.Errorf("unable to retrieve Calendar client: %v", err)
 	}
 
 	t := time.Now().Format(time.RFC3339)
 	events, err := srv.Events.List("primary").ShowDeleted(false).
 		SingleEvents(false).TimeMin(t).MaxResults(10).OrderBy("startTime").Do()
 	if err != nil {
-		log.Fatalf("Unable to retrieve next ten of the user's events: %v", err)
+		return fmt.Errorf("unable to retrieve next ten of the user's events: %v", err)
 	}
 	fmt.Println("Upcoming events:")
 	if len(events.Items) == 0 {
@@ -74,4 +71,5 @@ func main() {
 			fmt.Printf("%v (%v)\n", item.Summary, date)
 		}
 	}
+	return nil
 }
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/shiraily/gcal-sync/server"
+)
+
+func runServe(g *globals, args []string) error {
+	if len(args) != 0 {
+		return errUsage
+	}
+	server.Serve(g.path(), g.dryRun)
+	return nil
+}
+
+// runWatch manages channels of push notifications
+func runWatch(g *globals, args []string) error {
+	if len(args) == 0 {
+		return errUsage
+	}
+	fs, tenantId := tenantFlags("watch " + args[0])
+	force := fs.Bool("force", false, "for renew: start a new channel and stop the others now")
+	fs.Parse(args[1:])
+	rest := fs.Args()
+	switch args[0] {
+	case "stop":
+		if len(rest) != 1 && len(rest) != 2 {
+			return errUsage
+		}
+	case "start", "renew", "list":
+		if len(rest) != 0 {
+			return errUsage
+		}
+	default:
+		return errUsage
+	}
+
+	cli, closePool, err := g.client(*tenantId)
+	if err != nil {
+		return err
+	}
+	defer closePool()
+	switch args[0] {
+	case "start":
+		resourceId, err := cli.StartWatch()
+		if err != nil {
+			return fmt.Errorf("start watch: %s", err)
+		}
+		fmt.Printf("Watch id=%s\n", resourceId)
+	case "stop":
+		// resource id is read from state store if not given
+		resourceId := ""
+		if len(rest) == 2 {
+			resourceId = rest[1]
+		}
+		if err := cli.StopChannel(rest[0], resourceId); err != nil {
+			return fmt.Errorf("stop watch: %s", err)
+		}
+		fmt.Printf("Stop channel=%s\n", rest[0])
+	case "renew":
+		if *force {
+			chId, err := cli.RenewWatch()
+			if err != nil {
+				return fmt.Errorf("renew watch: %s", err)
+			}
+			fmt.Printf("Renewed channel=%s\n", chId)
+			return nil
+		}
+		// same as /renew
+		if err := cli.MaintainChannels(); err != nil {
+			return fmt.Errorf("maintain channels: %s", err)
+		}
+		fmt.Println("Channels maintained")
+	case "list":
+		channels, err := cli.Channels()
+		if err != nil {
+			return err
+		}
+		for _, ch := range channels {
+			expires := "unknown"
+			if !ch.ExpiresAt().IsZero() {
+				expires = ch.ExpiresAt().Format(time.RFC3339)
+			}
+			fmt.Printf("%s resource=%s confirmed=%t expires=%s\n", ch.Id, ch.ResourceId, ch.Confirmed, expires)
+		}
+	}
+	return nil
+}
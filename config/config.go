@@ -1,12 +1,17 @@
 package config
 
 import (
+	"fmt"
 	"io/ioutil"
-	"log"
+	"regexp"
+	"time"
 
 	"gopkg.in/yaml.v2"
 )
 
+// DefaultTenantId is used for the single-user settings at the top level of env.yaml
+const DefaultTenantId = "default"
+
 type Config struct {
 	Url     string `yaml:"url"` // webhook url
 	Project string `yaml:"project"`
@@ -17,25 +22,282 @@ type Config struct {
 
 	SrcTokenFile  string `yaml:"src_token_file,omitempty"`
 	DestTokenFile string `yaml:"dest_token_file,omitempty"`
+
+	// Tenants hosts sync pairs of many users in one deployment.
+	// If empty, the top level settings are used as the default tenant.
+	Tenants []Tenant `yaml:"tenants,omitempty"`
+
+	Store StoreConfig `yaml:"store,omitempty"`
+	Queue QueueConfig `yaml:"queue,omitempty"`
+	Auth  AuthConfig  `yaml:"auth,omitempty"`
+
+	Channel ChannelConfig `yaml:"channel,omitempty"`
+
+	// Mode is push (default) to sync on push notifications, or poll to sync on interval
+	// where no public webhook url is available
+	Mode string     `yaml:"mode,omitempty"`
+	Poll PollConfig `yaml:"poll,omitempty"`
+
+	Schedule ScheduleConfig `yaml:"schedule,omitempty"`
+
+	Retry RetryConfig `yaml:"retry,omitempty"`
+
+	Log   LogConfig   `yaml:"log,omitempty"`
+	Trace TraceConfig `yaml:"trace,omitempty"`
+
+	// DryRun only logs writes to calendars and state store, such as for trying new rules
+	DryRun bool `yaml:"dry_run,omitempty"`
+}
+
+// TraceConfig chooses where OpenTelemetry spans are exported
+type TraceConfig struct {
+	Exporter string `yaml:"exporter,omitempty"` // none (default), stdout, file or otlp
+	Path     string `yaml:"path,omitempty"`     // for file. default trace.json
+	// for otlp over HTTP. default localhost:4318
+	Endpoint string `yaml:"endpoint,omitempty"`
+	Insecure bool   `yaml:"insecure,omitempty"`
+	// SampleRatio is ratio of notifications traced. default 1
+	SampleRatio float64 `yaml:"sample_ratio,omitempty"`
+}
+
+// LogConfig sets format of logs
+type LogConfig struct {
+	Format string `yaml:"format,omitempty"` // text (default) or json with Cloud Logging severity
+	Level  string `yaml:"level,omitempty"`  // debug, info (default), warn or error
+	// Reveal logs sync tokens and titles of events, which are redacted by default
+	Reveal bool `yaml:"reveal,omitempty"`
+}
+
+// RetryConfig sets retry of Calendar API and Firestore calls failed by rate limit or server error.
+// Operations override Default by name: list, get, insert, patch, delete, watch, stop and firestore.
+type RetryConfig struct {
+	Default    RetryPolicy            `yaml:"default,omitempty"`
+	Operations map[string]RetryPolicy `yaml:"operations,omitempty"`
+}
+
+type RetryPolicy struct {
+	MaxAttempts    int           `yaml:"max_attempts,omitempty"`    // default 4. -1 disables retry
+	InitialBackoff time.Duration `yaml:"initial_backoff,omitempty"` // default 500ms
+	MaxBackoff     time.Duration `yaml:"max_backoff,omitempty"`     // default 30s
+	Jitter         float64       `yaml:"jitter,omitempty"`          // ratio of backoff. default 0.2
+}
+
+// ScheduleConfig runs jobs by scheduler in server with cron expressions like "0 5 * * *".
+// Empty disables the job.
+type ScheduleConfig struct {
+	Renew     string `yaml:"renew,omitempty"`     // channel manager
+	Reconcile string `yaml:"reconcile,omitempty"` // fix blocks of changed events
+	Cleanup   string `yaml:"cleanup,omitempty"`   // delete old run history
+	Report    string `yaml:"report,omitempty"`    // log summary of syncs
+
+	TimeZone     string        `yaml:"time_zone,omitempty"`     // default local
+	RunRetention time.Duration `yaml:"run_retention,omitempty"` // for cleanup. default 720h
+	// ReconcileMaxDeletes stops reconcile after deleting this many blocks in a run. default 10
+	ReconcileMaxDeletes int `yaml:"reconcile_max_deletes,omitempty"`
+}
+
+// PollConfig sets interval of poll mode
+type PollConfig struct {
+	MinInterval time.Duration `yaml:"min_interval,omitempty"` // default 1m
+	MaxInterval time.Duration `yaml:"max_interval,omitempty"` // default 15m
+	Jitter      float64       `yaml:"jitter,omitempty"`       // ratio of interval. default 0.2
+}
+
+// ChannelConfig sets lifecycle of push notification channels
+type ChannelConfig struct {
+	// TTL is lifetime requested for new channel. Google caps it, and uses its default if empty.
+	TTL time.Duration `yaml:"ttl,omitempty"`
+	// RenewMargin starts new channel this long before the current one expires. default 48h
+	RenewMargin time.Duration `yaml:"renew_margin,omitempty"`
+	// ConfirmTimeout stops new channel whose handshake has not arrived in this time. default 10m
+	ConfirmTimeout time.Duration `yaml:"confirm_timeout,omitempty"`
+	// CheckInterval runs channel manager by timer in server. Disabled if empty.
+	CheckInterval time.Duration `yaml:"check_interval,omitempty"`
+}
+
+// AuthConfig sets how scheduler calling /renew and /tasks is authenticated,
+// in addition to App Engine cron header
+type AuthConfig struct {
+	BearerToken string     `yaml:"bearer_token,omitempty"`
+	OIDC        OIDCConfig `yaml:"oidc,omitempty"`
+}
+
+// OIDCConfig accepts ID token signed by Google, such as one sent by Cloud Scheduler
+type OIDCConfig struct {
+	Audience string   `yaml:"audience,omitempty"`
+	Emails   []string `yaml:"emails,omitempty"` // service accounts allowed. required with audience
+}
+
+// StoreConfig chooses where sync tokens, channels and so on are saved
+type StoreConfig struct {
+	Type string `yaml:"type,omitempty"` // firestore (default), file, sqlite or memory
+	Path string `yaml:"path,omitempty"` // for file and sqlite
+}
+
+// QueueConfig sets how notifications are processed after acknowledged
+type QueueConfig struct {
+	Type string `yaml:"type,omitempty"` // memory (default) or push
+
+	// for memory
+	Workers     int           `yaml:"workers,omitempty"`
+	Debounce    time.Duration `yaml:"debounce,omitempty"` // "2s"
+	MaxAttempts int           `yaml:"max_attempts,omitempty"`
+	Backoff     time.Duration `yaml:"backoff,omitempty"`
+
+	// for push: jobs are created as tasks of Cloud Tasks queue, which delivers them to PushUrl (/tasks)
+	// with ID token of ServiceAccount for auth.oidc.audience
+	TaskQueue      string `yaml:"task_queue,omitempty"` // projects/PROJECT/locations/LOCATION/queues/QUEUE
+	PushUrl        string `yaml:"push_url,omitempty"`
+	ServiceAccount string `yaml:"service_account,omitempty"`
+	// Credentials is key file calling Cloud Tasks. default is Application Default Credentials
+	Credentials string `yaml:"credentials,omitempty"`
+}
+
+// Tenant is one user's sync pair with own calendars, credentials and rules
+type Tenant struct {
+	Id        string `yaml:"id"`
+	SrcCalId  string `yaml:"src"`
+	DestCalId string `yaml:"dest"`
+	Rules     []rule `yaml:"rules"`
+
+	// service account key for this tenant. default is the server's key
+	Credentials string `yaml:"credentials,omitempty"`
 }
 
 type rule struct {
+	// Name labels metrics of the rule instead of Match, which may be private. default is rule1, rule2 and so on
+	Name        string `yaml:"name,omitempty"`
 	Match       string `yaml:"match"`                  // "クリニック"
 	StartOffset int    `yaml:"start_offset,omitempty"` // "30" means minute
 	EndOffset   int    `yaml:"end_offset,omitempty"`
 	Ignore      bool   `yaml:"ignore,omitempty"`
-}
 
-func GetConfig() *Config {
-	var c Config
+	re *regexp.Regexp // compiled Match
+}
 
-	yamlFile, err := ioutil.ReadFile("env.yaml")
+// UnmarshalYAML compiles Match once when config is loaded, so that broken rules fail at loading
+func (r *rule) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	type plain rule
+	if err := unmarshal((*plain)(r)); err != nil {
+		return err
+	}
+	re, err := regexp.Compile(r.Match)
 	if err != nil {
-		log.Printf("yamlFile.Get err   #%v ", err)
+		return fmt.Errorf("rule %q: %s", r.Match, err)
+	}
+	r.re = re
+	return nil
+}
+
+// Label is Name, or position of the rule in the list starting at 1 if no name is given
+func (r *rule) Label(i int) string {
+	if r.Name != "" {
+		return r.Name
 	}
-	err = yaml.Unmarshal(yamlFile, &c)
+	return fmt.Sprintf("rule%d", i+1)
+}
+
+// MatchString reports whether title s matches the rule
+func (r *rule) MatchString(s string) bool {
+	return r.re != nil && r.re.MatchString(s)
+}
+
+// Load reads config file. Missing or broken file is an error.
+func Load(path string) (*Config, error) {
+	var c Config
+	yamlFile, err := ioutil.ReadFile(path)
 	if err != nil {
-		log.Fatalf("Unmarshal: %v", err)
+		return nil, fmt.Errorf("read config: %s", err)
+	}
+	if err := yaml.UnmarshalStrict(yamlFile, &c); err != nil {
+		return nil, fmt.Errorf("parse config %s: %s", path, err)
+	}
+	return &c, nil
+}
+
+// GetTenants returns all tenants. Top level settings are the default tenant when no tenants are set.
+func (c *Config) GetTenants() []Tenant {
+	if len(c.Tenants) == 0 {
+		return []Tenant{{
+			Id:        DefaultTenantId,
+			SrcCalId:  c.SrcCalId,
+			DestCalId: c.DestCalId,
+			Rules:     c.Rules,
+		}}
+	}
+	return c.Tenants
+}
+
+// GetTenant finds tenant by id. Empty id means the default tenant.
+func (c *Config) GetTenant(id string) (*Tenant, error) {
+	tenants := c.GetTenants()
+	if id == "" {
+		if len(tenants) == 1 {
+			return &tenants[0], nil
+		}
+		id = DefaultTenantId
+	}
+	for i := range tenants {
+		if tenants[i].Id == id {
+			return &tenants[i], nil
+		}
+	}
+	return nil, fmt.Errorf("unknown tenant: %s", id)
+}
+
+// Validate finds mistakes which Load does not, such as tenants without calendars
+func (c *Config) Validate() error {
+	switch c.Mode {
+	case "", "push":
+		if c.Url == "" {
+			return fmt.Errorf("url is required in push mode")
+		}
+	case "poll":
+	default:
+		return fmt.Errorf("unknown mode: %s", c.Mode)
+	}
+	if c.Auth.OIDC.Audience != "" && len(c.Auth.OIDC.Emails) == 0 {
+		return fmt.Errorf("auth.oidc.emails is required with audience")
+	}
+	if err := c.validateQueue(); err != nil {
+		return err
+	}
+	ids := map[string]bool{}
+	for _, t := range c.GetTenants() {
+		if t.Id == "" {
+			return fmt.Errorf("tenant without id")
+		}
+		if ids[t.Id] {
+			return fmt.Errorf("duplicated tenant: %s", t.Id)
+		}
+		ids[t.Id] = true
+		if t.SrcCalId == "" || t.DestCalId == "" {
+			return fmt.Errorf("tenant %s: src and dest are required", t.Id)
+		}
+	}
+	return nil
+}
+
+// validateQueue makes sure /tasks accepts tasks created by push queue
+func (c *Config) validateQueue() error {
+	q := c.Queue
+	switch q.Type {
+	case "", "memory":
+		return nil
+	case "push":
+	default:
+		return fmt.Errorf("unknown queue type: %s", q.Type)
+	}
+	if q.TaskQueue == "" || q.PushUrl == "" || q.ServiceAccount == "" {
+		return fmt.Errorf("queue.task_queue, push_url and service_account are required for push queue")
+	}
+	if c.Auth.OIDC.Audience == "" {
+		return fmt.Errorf("auth.oidc is required for push queue, since /tasks verifies ID token of tasks")
+	}
+	for _, e := range c.Auth.OIDC.Emails {
+		if e == q.ServiceAccount {
+			return nil
+		}
 	}
-	return &c
+	return fmt.Errorf("queue.service_account %s must be in auth.oidc.emails", q.ServiceAccount)
 }
@@ -0,0 +1,97 @@
+package health
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/shiraily/gcal-sync/logging"
+)
+
+const (
+	StatusOk   = "ok"
+	StatusFail = "fail"
+	// StatusWarn is failure of optional check, which does not make the server unready
+	StatusWarn = "warn"
+
+	checkTimeout = 10 * time.Second
+)
+
+// Check is a dependency needed to serve requests
+type Check struct {
+	Name string
+	Run  func(ctx context.Context) error
+	// Optional only warns on failure, for state worth seeing but not fixed by restarting
+	Optional bool
+}
+
+// Component is result of a check
+type Component struct {
+	Name   string `json:"name"`
+	Status string `json:"status"`
+	Error  string `json:"error,omitempty"`
+}
+
+type Report struct {
+	Status     string      `json:"status"`
+	Components []Component `json:"components"`
+}
+
+// Run runs checks concurrently. Report fails if any check fails, and warns if only optional ones fail.
+func Run(ctx context.Context, checks []Check) Report {
+	ctx, cancel := context.WithTimeout(ctx, checkTimeout)
+	defer cancel()
+	components := make([]Component, len(checks))
+	var wg sync.WaitGroup
+	for i, c := range checks {
+		wg.Add(1)
+		go func(i int, c Check) {
+			defer wg.Done()
+			components[i] = Component{Name: c.Name, Status: StatusOk}
+			if err := c.Run(ctx); err != nil {
+				components[i].Status = StatusFail
+				if c.Optional {
+					components[i].Status = StatusWarn
+				}
+				components[i].Error = err.Error()
+			}
+		}(i, c)
+	}
+	wg.Wait()
+	r := Report{Status: StatusOk, Components: components}
+	for _, c := range components {
+		switch {
+		case c.Status == StatusFail:
+			r.Status = StatusFail
+		case c.Status == StatusWarn && r.Status == StatusOk:
+			r.Status = StatusWarn
+		}
+	}
+	return r
+}
+
+// LiveHandler responds 200 while the process can serve HTTP
+func LiveHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain")
+	w.WriteHeader(http.StatusOK)
+	w.Write([]byte(StatusOk))
+}
+
+// ReadyHandler responds report of checks, with 503 if any fails. Warnings still respond 200.
+// checks is called on each request so that it follows reloaded config.
+func ReadyHandler(checks func() []Check) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		report := Run(r.Context(), checks())
+		w.Header().Set("Content-Type", "application/json")
+		if report.Status == StatusFail {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		} else {
+			w.WriteHeader(http.StatusOK)
+		}
+		if err := json.NewEncoder(w).Encode(report); err != nil {
+			logging.Error("readyz", "error", err)
+		}
+	}
+}
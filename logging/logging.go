@@ -0,0 +1,216 @@
+package logging
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/shiraily/gcal-sync/config"
+)
+
+// Level is severity of log. Names follow Cloud Logging.
+type Level int
+
+const (
+	LevelDebug Level = iota
+	LevelInfo
+	LevelWarn
+	LevelError
+)
+
+func (l Level) String() string {
+	switch l {
+	case LevelDebug:
+		return "DEBUG"
+	case LevelInfo:
+		return "INFO"
+	case LevelWarn:
+		return "WARNING"
+	default:
+		return "ERROR"
+	}
+}
+
+func ParseLevel(s string) (Level, error) {
+	switch strings.ToLower(s) {
+	case "debug":
+		return LevelDebug, nil
+	case "", "info":
+		return LevelInfo, nil
+	case "warn", "warning":
+		return LevelWarn, nil
+	case "error":
+		return LevelError, nil
+	}
+	return 0, fmt.Errorf("unknown log level: %s", s)
+}
+
+// output is shared by all loggers and changed by Configure
+var output = struct {
+	sync.Mutex
+	w      io.Writer
+	json   bool
+	level  Level
+	reveal bool
+}{w: os.Stderr, level: LevelInfo}
+
+// Configure sets format, level and redaction of logs. Logs of standard log package,
+// such as ones of libraries, are also written in the format at info level.
+func Configure(conf config.LogConfig) error {
+	level, err := ParseLevel(conf.Level)
+	if err != nil {
+		return err
+	}
+	var isJSON bool
+	switch conf.Format {
+	case "", "text":
+	case "json":
+		isJSON = true
+	default:
+		return fmt.Errorf("unknown log format: %s", conf.Format)
+	}
+	output.Lock()
+	output.json, output.level, output.reveal = isJSON, level, conf.Reveal
+	output.Unlock()
+	log.SetFlags(0)
+	log.SetOutput(stdWriter{})
+	return nil
+}
+
+// Logger writes logs with fields. It is immutable and safe for concurrent use.
+type Logger struct {
+	// fields are key and value pairs
+	fields []interface{}
+}
+
+var root = &Logger{}
+
+// With returns logger adding key and value pairs to logs
+func (l *Logger) With(kv ...interface{}) *Logger {
+	fields := make([]interface{}, 0, len(l.fields)+len(kv))
+	fields = append(fields, l.fields...)
+	fields = append(fields, kv...)
+	return &Logger{fields: fields}
+}
+
+func (l *Logger) Debug(msg string, kv ...interface{}) { l.write(LevelDebug, msg, kv) }
+func (l *Logger) Info(msg string, kv ...interface{})  { l.write(LevelInfo, msg, kv) }
+func (l *Logger) Warn(msg string, kv ...interface{})  { l.write(LevelWarn, msg, kv) }
+func (l *Logger) Error(msg string, kv ...interface{}) { l.write(LevelError, msg, kv) }
+
+func Debug(msg string, kv ...interface{}) { root.write(LevelDebug, msg, kv) }
+func Info(msg string, kv ...interface{})  { root.write(LevelInfo, msg, kv) }
+func Warn(msg string, kv ...interface{})  { root.write(LevelWarn, msg, kv) }
+func Error(msg string, kv ...interface{}) { root.write(LevelError, msg, kv) }
+
+// Fatal logs at error level and exits, only for failures on start up
+func Fatal(msg string, kv ...interface{}) {
+	root.write(LevelError, msg, kv)
+	os.Exit(1)
+}
+
+// With returns logger adding key and value pairs to logs
+func With(kv ...interface{}) *Logger {
+	return root.With(kv...)
+}
+
+func (l *Logger) write(level Level, msg string, kv []interface{}) {
+	output.Lock()
+	defer output.Unlock()
+	if level < output.level {
+		return
+	}
+	fields := append(append([]interface{}{}, l.fields...), kv...)
+	var b []byte
+	if output.json {
+		b = formatJSON(level, msg, fields)
+	} else {
+		b = formatText(level, msg, fields)
+	}
+	output.w.Write(b)
+}
+
+// formatJSON writes fields recognized by Cloud Logging: severity, message and time
+func formatJSON(level Level, msg string, fields []interface{}) []byte {
+	entry := map[string]interface{}{
+		"severity": level.String(),
+		"message":  msg,
+		"time":     time.Now().Format(time.RFC3339Nano),
+	}
+	for i := 0; i < len(fields); i += 2 {
+		key, value := field(fields, i)
+		if err, ok := value.(error); ok {
+			value = err.Error()
+		}
+		entry[key] = value
+	}
+	b, err := json.Marshal(entry)
+	if err != nil {
+		b, _ = json.Marshal(map[string]string{"severity": level.String(), "message": msg, "error": err.Error()})
+	}
+	return append(b, '\n')
+}
+
+func formatText(level Level, msg string, fields []interface{}) []byte {
+	var buf bytes.Buffer
+	buf.WriteString(time.Now().Format("2006/01/02 15:04:05"))
+	buf.WriteByte(' ')
+	buf.WriteString(level.String())
+	buf.WriteByte(' ')
+	buf.WriteString(msg)
+	for i := 0; i < len(fields); i += 2 {
+		key, value := field(fields, i)
+		s := fmt.Sprint(value)
+		if strings.ContainsAny(s, " \"=\n") || s == "" {
+			s = strconv.Quote(s)
+		}
+		fmt.Fprintf(&buf, " %s=%s", key, s)
+	}
+	buf.WriteByte('\n')
+	return buf.Bytes()
+}
+
+// field returns pair at i. Odd one out is logged with key !BADKEY.
+func field(fields []interface{}, i int) (string, interface{}) {
+	if i+1 >= len(fields) {
+		return "!BADKEY", fields[i]
+	}
+	return fmt.Sprint(fields[i]), fields[i+1]
+}
+
+// stdWriter passes logs of standard log package
+type stdWriter struct{}
+
+func (stdWriter) Write(p []byte) (int, error) {
+	root.write(LevelInfo, strings.TrimRight(string(p), "\n"), nil)
+	return len(p), nil
+}
+
+type ctxKey struct{}
+
+// NewContext returns context carrying l
+func NewContext(ctx context.Context, l *Logger) context.Context {
+	return context.WithValue(ctx, ctxKey{}, l)
+}
+
+// FromContext returns logger in ctx, or one without fields
+func FromContext(ctx context.Context) *Logger {
+	if l, ok := ctx.Value(ctxKey{}).(*Logger); ok {
+		return l
+	}
+	return root
+}
+
+// WithFields returns context whose logger adds key and value pairs,
+// such as correlation id of a notification
+func WithFields(ctx context.Context, kv ...interface{}) context.Context {
+	return NewContext(ctx, FromContext(ctx).With(kv...))
+}
@@ -0,0 +1,34 @@
+package logging
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+)
+
+// Secret hides sync tokens, channel tokens and so on unless log.reveal is set.
+// Short hash is kept so that the same secret can be traced across logs.
+func Secret(s string) string {
+	if s == "" || revealed() {
+		return s
+	}
+	return "[redacted:" + digest(s) + "]"
+}
+
+// Title hides title of events, which may be private, unless log.reveal is set
+func Title(s string) string {
+	if s == "" || revealed() {
+		return s
+	}
+	return "[redacted]"
+}
+
+func revealed() bool {
+	output.Lock()
+	defer output.Unlock()
+	return output.reveal
+}
+
+func digest(s string) string {
+	sum := sha256.Sum256([]byte(s))
+	return hex.EncodeToString(sum[:4])
+}
@@ -1,65 +1,15 @@
 package main
 
 import (
-	"log"
-	"net/http"
-	"os"
+	"flag"
 
-	"github.com/shiraily/gcal-sync/calendar"
+	"github.com/shiraily/gcal-sync/server"
 )
 
+// main is the entry point of App Engine. Same as `gcal-sync serve` of cmd/gcal-sync.
 func main() {
-	http.HandleFunc("/notify", OnNotify)
-	http.HandleFunc("/renew", OnRenew)
-
-	port := os.Getenv("PORT")
-	if port == "" {
-		port = "3000"
-		log.Printf("Defaulting to port %s", port)
-	}
-
-	log.Printf("Listening on port %s", port)
-	if err := http.ListenAndServe(":"+port, nil); err != nil {
-		log.Fatal(err)
-	}
-}
-
-func OnNotify(w http.ResponseWriter, r *http.Request) {
-	w.Header().Set("Content-Type", "text/plain")
-	cli := calendar.NewClient()
-	defer cli.Close()
-	log.Printf("channelId=%s, resourceId=%s", r.Header["X-Goog-Channel-Id"], r.Header["X-Goog-Resource-Id"])
-	var err error
-	if len(r.Header["X-Goog-Resource-State"]) > 0 && r.Header["X-Goog-Resource-State"][0] == "exists" {
-		err = cli.Sync()
-	} else {
-		// initial
-		err = cli.SyncInitial()
-	}
-	if err != nil {
-		log.Printf("debug error: %s", err)
-		w.WriteHeader(http.StatusInternalServerError)
-	} else {
-		w.WriteHeader(http.StatusOK)
-	}
-
-	if _, err := w.Write([]byte("")); err != nil {
-		log.Fatal(err)
-		return
-	}
-}
-
-func OnRenew(w http.ResponseWriter, r *http.Request) {
-	w.Header().Set("Content-Type", "text/plain")
-	cli := calendar.NewClient()
-	defer cli.Close()
-	channelId, err := cli.RenewWatch()
-	if err != nil {
-		log.Fatalf("Renew watch: %s", err)
-	} else {
-		w.WriteHeader(http.StatusOK)
-	}
-	if _, err := w.Write([]byte(channelId)); err != nil {
-		log.Fatal(err)
-	}
+	configPath := flag.String("config", "env.yaml", "config file")
+	dryRun := flag.Bool("dry-run", false, "only log writes to calendars and state store")
+	flag.Parse()
+	server.Serve(*configPath, *dryRun)
 }
@@ -0,0 +1,116 @@
+package metrics
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+const namespace = "gcal_sync"
+
+var (
+	// NotificationsReceived is labeled by X-Goog-Resource-State
+	NotificationsReceived = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "notifications_received_total",
+		Help:      "Push notifications received, by resource state.",
+	}, []string{"state"})
+
+	// NotificationsRejected counts notifications not from the active channel
+	NotificationsRejected = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "notifications_rejected_total",
+		Help:      "Push notifications rejected by channel verification.",
+	})
+
+	// SyncsRun is labeled by result: ok or error
+	SyncsRun = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "syncs_total",
+		Help:      "Syncs run, by result.",
+	}, []string{"tenant", "result"})
+
+	SyncDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "sync_duration_seconds",
+		Help:      "Time taken by a sync.",
+		Buckets:   []float64{.1, .25, .5, 1, 2.5, 5, 10, 30, 60},
+	}, []string{"tenant"})
+
+	EventsProcessed = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "events_processed_total",
+		Help:      "Changed source events processed by syncs.",
+	}, []string{"tenant"})
+
+	EventsPerSync = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "events_per_sync",
+		Help:      "Changed source events in a sync.",
+		Buckets:   []float64{0, 1, 2, 5, 10, 20, 50, 100},
+	}, []string{"tenant"})
+
+	// Blocks is labeled by action: created, patched, deleted, forgotten or kept
+	Blocks = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "blocks_total",
+		Help:      "Blocks on destination calendar changed, by action.",
+	}, []string{"tenant", "action"})
+
+	// BlocksSkipped is labeled by reason why no block is needed for the event
+	BlocksSkipped = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "blocks_skipped_total",
+		Help:      "Source events not blocked, by reason.",
+	}, []string{"tenant", "reason"})
+
+	// APIErrors is labeled by operation of Calendar API and HTTP status code, or "network"
+	APIErrors = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "api_errors_total",
+		Help:      "Failed calls of Calendar API including retried ones, by operation and code.",
+	}, []string{"operation", "code"})
+
+	// RuleHits is labeled by name of the rule, or "default" if no rule matches.
+	// Match is not used since it may reveal titles of private events.
+	RuleHits = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "rule_hits_total",
+		Help:      "Source events matched by rules, by rule.",
+	}, []string{"tenant", "rule"})
+)
+
+// channelExpiry reports seconds until the active channel of each tenant expires, on each scrape
+type channelExpiry struct {
+	desc *prometheus.Desc
+	// expirations returns expiration of active channels by tenant
+	expirations func() map[string]time.Time
+}
+
+// RegisterChannelExpiry exports expirations of active channels by tenant
+func RegisterChannelExpiry(expirations func() map[string]time.Time) {
+	prometheus.MustRegister(&channelExpiry{
+		desc: prometheus.NewDesc(namespace+"_channel_expiry_seconds",
+			"Seconds until the active push notification channel expires. Negative if expired.",
+			[]string{"tenant"}, nil),
+		expirations: expirations,
+	})
+}
+
+func (c *channelExpiry) Describe(ch chan<- *prometheus.Desc) {
+	ch <- c.desc
+}
+
+func (c *channelExpiry) Collect(ch chan<- prometheus.Metric) {
+	for tenant, exp := range c.expirations() {
+		ch <- prometheus.MustNewConstMetric(c.desc, prometheus.GaugeValue, time.Until(exp).Seconds(), tenant)
+	}
+}
+
+// Handler serves metrics in Prometheus format
+func Handler() http.Handler {
+	return promhttp.Handler()
+}
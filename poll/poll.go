@@ -0,0 +1,89 @@
+package poll
+
+import (
+	"context"
+	"math/rand"
+	"time"
+
+	"github.com/shiraily/gcal-sync/config"
+	"github.com/shiraily/gcal-sync/logging"
+)
+
+const (
+	defaultMinInterval = time.Minute
+	defaultMaxInterval = 15 * time.Minute
+	defaultJitter      = 0.2
+)
+
+// Poller syncs periodically for deployments which cannot receive push notifications.
+// Interval shortens to the minimum when changes are found, and grows while nothing changes or sync fails.
+type Poller struct {
+	Name        string
+	MinInterval time.Duration
+	MaxInterval time.Duration
+	// Jitter randomizes interval by this ratio not to poll at the same time as other pollers
+	Jitter float64
+	// Sync returns number of changes
+	Sync func() (int, error)
+}
+
+func NewPoller(conf config.PollConfig, name string, sync func() (int, error)) *Poller {
+	p := &Poller{
+		Name:        name,
+		MinInterval: conf.MinInterval,
+		MaxInterval: conf.MaxInterval,
+		Jitter:      conf.Jitter,
+		Sync:        sync,
+	}
+	if p.MinInterval <= 0 {
+		p.MinInterval = defaultMinInterval
+	}
+	if p.MaxInterval <= 0 {
+		p.MaxInterval = defaultMaxInterval
+	}
+	if p.MaxInterval < p.MinInterval {
+		p.MaxInterval = p.MinInterval
+	}
+	if p.Jitter <= 0 {
+		p.Jitter = defaultJitter
+	}
+	return p
+}
+
+// Run polls until ctx is done
+func (p *Poller) Run(ctx context.Context) {
+	interval := p.MinInterval
+	for {
+		n, err := p.Sync()
+		if err != nil {
+			logging.Error("poll", "tenant", p.Name, "error", err)
+		}
+		interval = p.next(interval, n, err)
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(p.jitter(interval)):
+		}
+	}
+}
+
+func (p *Poller) next(interval time.Duration, changes int, err error) time.Duration {
+	switch {
+	case err != nil:
+		interval *= 2
+	case changes > 0:
+		// more changes likely follow
+		return p.MinInterval
+	default:
+		interval += interval / 2
+	}
+	if interval > p.MaxInterval {
+		return p.MaxInterval
+	}
+	return interval
+}
+
+func (p *Poller) jitter(interval time.Duration) time.Duration {
+	delta := (rand.Float64()*2 - 1) * p.Jitter * float64(interval)
+	return interval + time.Duration(delta)
+}
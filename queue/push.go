@@ -0,0 +1,115 @@
+package queue
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+
+	"github.com/shiraily/gcal-sync/logging"
+)
+
+// Publisher sends job to a remote queue such as Cloud Tasks, which delivers it to PushHandler
+type Publisher interface {
+	Publish(ctx context.Context, data []byte) error
+}
+
+// pushQueue leaves running and retrying jobs to the remote queue
+type pushQueue struct {
+	pub Publisher
+}
+
+func NewPushQueue(pub Publisher) Queue {
+	return &pushQueue{pub: pub}
+}
+
+func (q *pushQueue) Enqueue(ctx context.Context, job Job) error {
+	b, err := json.Marshal(job)
+	if err != nil {
+		return err
+	}
+	if err := q.pub.Publish(ctx, b); err != nil {
+		return fmt.Errorf("publish job: %s", err)
+	}
+	return nil
+}
+
+// Retrying is unknown since the remote queue retries jobs
+func (q *pushQueue) Retrying(tenantId string) (int, bool) {
+	return 0, false
+}
+
+func (q *pushQueue) Close() error {
+	return nil
+}
+
+// HTTPPublisher posts job directly to PushHandler and waits for the job, so it is only a local fake of
+// Cloud Tasks for tests and development. Client must add credentials accepted by /tasks.
+type HTTPPublisher struct {
+	Url    string
+	Client *http.Client
+}
+
+func (p *HTTPPublisher) Publish(ctx context.Context, data []byte) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, p.Url, bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	cli := p.Client
+	if cli == nil {
+		cli = http.DefaultClient
+	}
+	res, err := cli.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode >= 300 {
+		return fmt.Errorf("status %d", res.StatusCode)
+	}
+	return nil
+}
+
+// pubsubPush is the body of Pub/Sub push subscription
+type pubsubPush struct {
+	Message *struct {
+		Data []byte `json:"data"`
+	} `json:"message"`
+}
+
+// PushHandler runs job delivered by Cloud Tasks (raw job) or Pub/Sub push subscription (wrapped in message).
+// Failure responds 503 so that the remote queue retries, except permanent one.
+func PushHandler(handler Handler) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		b, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		var push pubsubPush
+		if err := json.Unmarshal(b, &push); err == nil && push.Message != nil {
+			b = push.Message.Data
+		}
+		var job Job
+		if err := json.Unmarshal(b, &job); err != nil || job.TenantId == "" {
+			logging.Warn("invalid job", "body", string(b))
+			// bad job never succeeds, so do not let it be retried
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		if err := handler(r.Context(), job); err != nil {
+			job.logger().Error("run job", "error", err)
+			if IsPermanent(err) {
+				// 2xx acknowledges the job, since retrying never succeeds
+				w.WriteHeader(http.StatusAccepted)
+				return
+			}
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+	}
+}
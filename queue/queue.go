@@ -0,0 +1,225 @@
+package queue
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/shiraily/gcal-sync/config"
+	"github.com/shiraily/gcal-sync/logging"
+)
+
+const (
+	KindSync    = "sync"
+	KindInitial = "initial"
+)
+
+// ErrClosed is returned when enqueueing to closed queue
+var ErrClosed = errors.New("queue is closed")
+
+// Job is a sync requested by push notification
+type Job struct {
+	TenantId string `json:"tenant"`
+	Kind     string `json:"kind"`
+	Attempt  int    `json:"attempt,omitempty"`
+	// CorrelationId relates logs of the job to the notification
+	CorrelationId string `json:"correlation,omitempty"`
+	// Trace carries span of the notification to the job
+	Trace map[string]string `json:"trace,omitempty"`
+}
+
+func (j Job) logger() *logging.Logger {
+	return logging.With("tenant", j.TenantId, "kind", j.Kind, "correlation_id", j.CorrelationId)
+}
+
+// key identifies jobs merged by debouncing
+func (j Job) key() string {
+	return j.TenantId + ":" + j.Kind
+}
+
+// Handler runs a job. Returning error retries the job, unless it has Temporary method returning false.
+type Handler func(ctx context.Context, job Job) error
+
+// IsPermanent reports whether err says retrying never succeeds
+func IsPermanent(err error) bool {
+	var t interface{ Temporary() bool }
+	return errors.As(err, &t) && !t.Temporary()
+}
+
+type Queue interface {
+	Enqueue(ctx context.Context, job Job) error
+	// Retrying returns number of failed jobs of the tenant waiting for retry.
+	// ok is false if unknown, such as for remote queue.
+	Retrying(tenantId string) (n int, ok bool)
+	// Close waits for running jobs. Jobs not started yet are dropped.
+	Close() error
+}
+
+// Open creates the queue chosen in config. handler is not used by push queue since
+// jobs are run by PushHandler receiving them.
+func Open(ctx context.Context, conf *config.Config, handler Handler) (Queue, error) {
+	if conf.Queue.Type == "push" {
+		pub, err := NewTasksPublisher(ctx, conf.Queue, conf.Auth.OIDC.Audience)
+		if err != nil {
+			return nil, err
+		}
+		return NewPushQueue(pub), nil
+	}
+	qc := conf.Queue
+	return NewMemoryQueue(handler, Options{
+		Workers:     qc.Workers,
+		Debounce:    qc.Debounce,
+		MaxAttempts: qc.MaxAttempts,
+		Backoff:     qc.Backoff,
+	}), nil
+}
+
+type Options struct {
+	Workers int
+	// Debounce delays job and merges same jobs enqueued in the meantime
+	Debounce    time.Duration
+	MaxAttempts int
+	// Backoff is the first interval of retry. It doubles for each attempt.
+	Backoff time.Duration
+}
+
+func (o Options) withDefaults() Options {
+	if o.Workers <= 0 {
+		o.Workers = 2
+	}
+	if o.Debounce <= 0 {
+		o.Debounce = 2 * time.Second
+	}
+	if o.MaxAttempts <= 0 {
+		o.MaxAttempts = 5
+	}
+	if o.Backoff <= 0 {
+		o.Backoff = 5 * time.Second
+	}
+	return o
+}
+
+// memoryQueue runs jobs by worker pool in process
+type memoryQueue struct {
+	handler Handler
+	opts    Options
+	jobs    chan Job
+	done    chan struct{}
+	wg      sync.WaitGroup
+
+	mu     sync.Mutex
+	timers map[string]*time.Timer
+	// retrying counts jobs waiting for retry by tenant
+	retrying map[string]int
+	closed   bool
+}
+
+func NewMemoryQueue(handler Handler, opts Options) Queue {
+	q := &memoryQueue{
+		handler:  handler,
+		opts:     opts.withDefaults(),
+		jobs:     make(chan Job),
+		done:     make(chan struct{}),
+		timers:   map[string]*time.Timer{},
+		retrying: map[string]int{},
+	}
+	for i := 0; i < q.opts.Workers; i++ {
+		q.wg.Add(1)
+		go q.work()
+	}
+	return q
+}
+
+func (q *memoryQueue) Enqueue(ctx context.Context, job Job) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.closed {
+		return ErrClosed
+	}
+	key := job.key()
+	if t, ok := q.timers[key]; ok && t.Stop() {
+		// not dispatched yet, so merge into it
+		t.Reset(q.opts.Debounce)
+		return nil
+	}
+	var t *time.Timer
+	t = time.AfterFunc(q.opts.Debounce, func() {
+		q.mu.Lock()
+		if q.timers[key] == t {
+			delete(q.timers, key)
+		}
+		q.mu.Unlock()
+		q.dispatch(job)
+	})
+	q.timers[key] = t
+	return nil
+}
+
+func (q *memoryQueue) dispatch(job Job) {
+	select {
+	case q.jobs <- job:
+	case <-q.done:
+	}
+}
+
+func (q *memoryQueue) work() {
+	defer q.wg.Done()
+	for {
+		select {
+		case job := <-q.jobs:
+			q.run(job)
+		case <-q.done:
+			return
+		}
+	}
+}
+
+func (q *memoryQueue) run(job Job) {
+	err := q.handler(context.Background(), job)
+	if err == nil {
+		return
+	}
+	job.Attempt++
+	if IsPermanent(err) {
+		job.logger().Error("drop job", "error", err)
+		return
+	}
+	if job.Attempt >= q.opts.MaxAttempts {
+		job.logger().Error("give up job", "attempts", job.Attempt, "error", err)
+		return
+	}
+	delay := q.opts.Backoff << (job.Attempt - 1)
+	job.logger().Warn("retry job", "delay", delay, "error", err)
+	q.mu.Lock()
+	q.retrying[job.TenantId]++
+	q.mu.Unlock()
+	time.AfterFunc(delay, func() {
+		q.mu.Lock()
+		q.retrying[job.TenantId]--
+		q.mu.Unlock()
+		q.dispatch(job)
+	})
+}
+
+func (q *memoryQueue) Retrying(tenantId string) (int, bool) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return q.retrying[tenantId], true
+}
+
+func (q *memoryQueue) Close() error {
+	q.mu.Lock()
+	if q.closed {
+		q.mu.Unlock()
+		return nil
+	}
+	q.closed = true
+	for _, t := range q.timers {
+		t.Stop()
+	}
+	q.mu.Unlock()
+	close(q.done)
+	q.wg.Wait()
+	return nil
+}
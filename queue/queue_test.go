@@ -0,0 +1,310 @@
+package queue
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"google.golang.org/api/cloudtasks/v2"
+	"google.golang.org/api/option"
+
+	"github.com/shiraily/gcal-sync/auth"
+	"github.com/shiraily/gcal-sync/config"
+)
+
+// recorder is a handler counting jobs by key, failing by errs in order
+type recorder struct {
+	mu    sync.Mutex
+	calls map[string]int
+	errs  []error
+	ran   chan Job
+}
+
+func newRecorder(errs ...error) *recorder {
+	return &recorder{calls: map[string]int{}, errs: errs, ran: make(chan Job, 100)}
+}
+
+func (r *recorder) handle(ctx context.Context, job Job) error {
+	r.mu.Lock()
+	r.calls[job.key()]++
+	var err error
+	if len(r.errs) > 0 {
+		err, r.errs = r.errs[0], r.errs[1:]
+	}
+	r.mu.Unlock()
+	r.ran <- job
+	return err
+}
+
+func (r *recorder) count(key string) int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.calls[key]
+}
+
+func (r *recorder) wait(t *testing.T) Job {
+	t.Helper()
+	select {
+	case job := <-r.ran:
+		return job
+	case <-time.After(2 * time.Second):
+		t.Fatal("job was not run")
+		return Job{}
+	}
+}
+
+func (r *recorder) waitNone(t *testing.T, d time.Duration) {
+	t.Helper()
+	select {
+	case job := <-r.ran:
+		t.Fatalf("unexpected run of %+v", job)
+	case <-time.After(d):
+	}
+}
+
+type permanentError struct{}
+
+func (permanentError) Error() string   { return "permanent" }
+func (permanentError) Temporary() bool { return false }
+
+func TestMemoryQueueDebounce(t *testing.T) {
+	r := newRecorder()
+	q := NewMemoryQueue(r.handle, Options{Debounce: 50 * time.Millisecond})
+	defer q.Close()
+
+	ctx := context.Background()
+	for i := 0; i < 3; i++ {
+		if err := q.Enqueue(ctx, Job{TenantId: "a", Kind: KindSync}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := q.Enqueue(ctx, Job{TenantId: "b", Kind: KindSync}); err != nil {
+		t.Fatal(err)
+	}
+	r.wait(t)
+	r.wait(t)
+	r.waitNone(t, 150*time.Millisecond)
+	if n := r.count("a:sync"); n != 1 {
+		t.Errorf("jobs of a: want 1, got %d", n)
+	}
+	if n := r.count("b:sync"); n != 1 {
+		t.Errorf("jobs of b: want 1, got %d", n)
+	}
+}
+
+func TestMemoryQueueRetry(t *testing.T) {
+	r := newRecorder(errors.New("rate limit"), errors.New("server error"))
+	q := NewMemoryQueue(r.handle, Options{Debounce: time.Millisecond, Backoff: 10 * time.Millisecond})
+	defer q.Close()
+
+	if err := q.Enqueue(context.Background(), Job{TenantId: "a", Kind: KindSync}); err != nil {
+		t.Fatal(err)
+	}
+	for attempt := 0; attempt < 3; attempt++ {
+		if job := r.wait(t); job.Attempt != attempt {
+			t.Errorf("attempt: want %d, got %d", attempt, job.Attempt)
+		}
+	}
+	r.waitNone(t, 100*time.Millisecond)
+	if n, _ := q.Retrying("a"); n != 0 {
+		t.Errorf("retrying: want 0, got %d", n)
+	}
+}
+
+func TestMemoryQueueGiveUp(t *testing.T) {
+	transient := errors.New("server error")
+	r := newRecorder(transient, transient, transient)
+	q := NewMemoryQueue(r.handle, Options{Debounce: time.Millisecond, Backoff: time.Millisecond, MaxAttempts: 2})
+	defer q.Close()
+
+	if err := q.Enqueue(context.Background(), Job{TenantId: "a", Kind: KindSync}); err != nil {
+		t.Fatal(err)
+	}
+	r.wait(t)
+	r.wait(t)
+	r.waitNone(t, 50*time.Millisecond)
+}
+
+func TestMemoryQueuePermanentError(t *testing.T) {
+	r := newRecorder(permanentError{})
+	q := NewMemoryQueue(r.handle, Options{Debounce: time.Millisecond, Backoff: time.Millisecond})
+	defer q.Close()
+
+	if err := q.Enqueue(context.Background(), Job{TenantId: "a", Kind: KindSync}); err != nil {
+		t.Fatal(err)
+	}
+	r.wait(t)
+	r.waitNone(t, 50*time.Millisecond)
+}
+
+func TestMemoryQueueCloseDrains(t *testing.T) {
+	started := make(chan struct{})
+	release := make(chan struct{})
+	var finished bool
+	q := NewMemoryQueue(func(ctx context.Context, job Job) error {
+		close(started)
+		<-release
+		finished = true
+		return nil
+	}, Options{Debounce: time.Millisecond})
+
+	if err := q.Enqueue(context.Background(), Job{TenantId: "a", Kind: KindSync}); err != nil {
+		t.Fatal(err)
+	}
+	<-started
+	closed := make(chan struct{})
+	go func() {
+		q.Close()
+		close(closed)
+	}()
+	select {
+	case <-closed:
+		t.Fatal("Close returned before running job finished")
+	case <-time.After(50 * time.Millisecond):
+	}
+	close(release)
+	select {
+	case <-closed:
+	case <-time.After(2 * time.Second):
+		t.Fatal("Close did not return")
+	}
+	if !finished {
+		t.Error("running job did not finish")
+	}
+	if err := q.Enqueue(context.Background(), Job{TenantId: "a", Kind: KindSync}); !errors.Is(err, ErrClosed) {
+		t.Errorf("enqueue after close: want ErrClosed, got %v", err)
+	}
+}
+
+// bearer adds token to requests, as Cloud Tasks does with OIDC token
+type bearer struct {
+	token string
+}
+
+func (b bearer) RoundTrip(req *http.Request) (*http.Response, error) {
+	req = req.Clone(req.Context())
+	req.Header.Set("Authorization", "Bearer "+b.token)
+	return http.DefaultTransport.RoundTrip(req)
+}
+
+func newTaskEndpoint(handler Handler) *httptest.Server {
+	v := &auth.Verifier{BearerToken: "secret"}
+	return httptest.NewServer(v.Protect(PushHandler(handler)))
+}
+
+func TestPushQueue(t *testing.T) {
+	r := newRecorder(errors.New("server error"), permanentError{})
+	srv := newTaskEndpoint(r.handle)
+	defer srv.Close()
+	q := NewPushQueue(&HTTPPublisher{Url: srv.URL, Client: &http.Client{Transport: bearer{"secret"}}})
+	defer q.Close()
+
+	ctx := context.Background()
+	job := Job{TenantId: "a", Kind: KindSync, CorrelationId: "c1"}
+	// transient failure responds 503, so that the remote queue retries
+	if err := q.Enqueue(ctx, job); err == nil {
+		t.Error("want error of transient failure")
+	}
+	// permanent failure is acknowledged
+	if err := q.Enqueue(ctx, job); err != nil {
+		t.Errorf("permanent failure: %s", err)
+	}
+	if err := q.Enqueue(ctx, job); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 3; i++ {
+		if got := r.wait(t); got.CorrelationId != "c1" {
+			t.Errorf("job: want %+v, got %+v", job, got)
+		}
+	}
+}
+
+func TestPushQueueRejectsUnauthorized(t *testing.T) {
+	r := newRecorder()
+	srv := newTaskEndpoint(r.handle)
+	defer srv.Close()
+
+	for name, cli := range map[string]*http.Client{
+		"no token":    http.DefaultClient,
+		"wrong token": {Transport: bearer{"wrong"}},
+	} {
+		q := NewPushQueue(&HTTPPublisher{Url: srv.URL, Client: cli})
+		if err := q.Enqueue(context.Background(), Job{TenantId: "a", Kind: KindSync}); err == nil {
+			t.Errorf("%s: want error", name)
+		}
+	}
+	r.waitNone(t, 50*time.Millisecond)
+}
+
+func TestPushHandlerRejectsBadJob(t *testing.T) {
+	r := newRecorder()
+	srv := newTaskEndpoint(r.handle)
+	defer srv.Close()
+
+	err := (&HTTPPublisher{Url: srv.URL, Client: &http.Client{Transport: bearer{"secret"}}}).
+		Publish(context.Background(), []byte(`{"kind":"sync"}`))
+	if err == nil || err.Error() != "status 400" {
+		t.Errorf("want status 400, got %v", err)
+	}
+	r.waitNone(t, 50*time.Millisecond)
+}
+
+func TestTasksPublisher(t *testing.T) {
+	var mu sync.Mutex
+	var path string
+	var got cloudtasks.CreateTaskRequest
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		path = r.URL.Path
+		if err := json.NewDecoder(r.Body).Decode(&got); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"name":"task"}`))
+	}))
+	defer srv.Close()
+
+	ctx := context.Background()
+	pub, err := NewTasksPublisher(ctx, config.QueueConfig{
+		TaskQueue:      "projects/p/locations/l/queues/q",
+		PushUrl:        "https://example.com/tasks",
+		ServiceAccount: "tasks@p.iam.gserviceaccount.com",
+	}, "https://example.com/renew", option.WithEndpoint(srv.URL), option.WithHTTPClient(srv.Client()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	job := Job{TenantId: "a", Kind: KindSync, CorrelationId: "c1"}
+	if err := NewPushQueue(pub).Enqueue(ctx, job); err != nil {
+		t.Fatal(err)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	if path != "/v2/projects/p/locations/l/queues/q/tasks" {
+		t.Errorf("path: %s", path)
+	}
+	req := got.Task.HttpRequest
+	if req.Url != "https://example.com/tasks" || req.HttpMethod != "POST" {
+		t.Errorf("unexpected target %s %s", req.HttpMethod, req.Url)
+	}
+	if req.OidcToken == nil || req.OidcToken.ServiceAccountEmail != "tasks@p.iam.gserviceaccount.com" ||
+		req.OidcToken.Audience != "https://example.com/renew" {
+		t.Errorf("unexpected ID token %+v", req.OidcToken)
+	}
+	b, err := base64.StdEncoding.DecodeString(req.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var delivered Job
+	if err := json.Unmarshal(b, &delivered); err != nil || delivered.TenantId != "a" || delivered.CorrelationId != "c1" {
+		t.Errorf("job: want %+v, got %s", job, b)
+	}
+}
@@ -0,0 +1,57 @@
+package queue
+
+import (
+	"context"
+	"encoding/base64"
+	"fmt"
+
+	"google.golang.org/api/cloudtasks/v2"
+	"google.golang.org/api/option"
+
+	"github.com/shiraily/gcal-sync/config"
+)
+
+// TasksPublisher creates a task of Cloud Tasks for each job. Cloud Tasks delivers it to /tasks
+// with ID token, and retries it while /tasks responds error.
+type TasksPublisher struct {
+	queue          string
+	url            string
+	serviceAccount string
+	audience       string
+	svc            *cloudtasks.Service
+}
+
+// NewTasksPublisher creates publisher to the queue in conf. Tasks carry ID token for audience,
+// which is verified by /tasks.
+func NewTasksPublisher(ctx context.Context, conf config.QueueConfig, audience string, opts ...option.ClientOption) (*TasksPublisher, error) {
+	if conf.Credentials != "" {
+		opts = append(opts, option.WithCredentialsFile(conf.Credentials))
+	}
+	svc, err := cloudtasks.NewService(ctx, opts...)
+	if err != nil {
+		return nil, fmt.Errorf("create Cloud Tasks client: %s", err)
+	}
+	return &TasksPublisher{
+		queue:          conf.TaskQueue,
+		url:            conf.PushUrl,
+		serviceAccount: conf.ServiceAccount,
+		audience:       audience,
+		svc:            svc,
+	}, nil
+}
+
+func (p *TasksPublisher) Publish(ctx context.Context, data []byte) error {
+	task := &cloudtasks.Task{HttpRequest: &cloudtasks.HttpRequest{
+		Url:        p.url,
+		HttpMethod: "POST",
+		Headers:    map[string]string{"Content-Type": "application/json"},
+		Body:       base64.StdEncoding.EncodeToString(data),
+		OidcToken:  &cloudtasks.OidcToken{ServiceAccountEmail: p.serviceAccount, Audience: p.audience},
+	}}
+	_, err := p.svc.Projects.Locations.Queues.Tasks.Create(p.queue, &cloudtasks.CreateTaskRequest{Task: task}).
+		Context(ctx).Do()
+	if err != nil {
+		return fmt.Errorf("create task: %s", err)
+	}
+	return nil
+}
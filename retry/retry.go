@@ -0,0 +1,169 @@
+package retry
+
+import (
+	"context"
+	"errors"
+	"math/rand"
+	"net/http"
+	"time"
+
+	"google.golang.org/api/googleapi"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"github.com/shiraily/gcal-sync/config"
+)
+
+const (
+	defaultMaxAttempts    = 4
+	defaultInitialBackoff = 500 * time.Millisecond
+	defaultMaxBackoff     = 30 * time.Second
+	defaultJitter         = 0.2
+	// maxRetryAfter caps Retry-After sent by server not to block sync for long
+	maxRetryAfter = 5 * time.Minute
+)
+
+// Policy retries operation failing with rate limit or server error.
+// Backoff doubles from InitialBackoff up to MaxBackoff, and Retry-After of the response is honored if longer.
+type Policy struct {
+	MaxAttempts    int
+	InitialBackoff time.Duration
+	MaxBackoff     time.Duration
+	// Jitter randomizes backoff by this ratio not to retry at the same time as other clients
+	Jitter float64
+	// Retryable decides which errors are retried. default is IsRetryable.
+	Retryable func(err error) bool
+}
+
+// For returns policy of the operation, whose settings override default ones in conf
+func For(conf config.RetryConfig, op string) *Policy {
+	p := &Policy{
+		MaxAttempts:    conf.Default.MaxAttempts,
+		InitialBackoff: conf.Default.InitialBackoff,
+		MaxBackoff:     conf.Default.MaxBackoff,
+		Jitter:         conf.Default.Jitter,
+	}
+	if o, ok := conf.Operations[op]; ok {
+		if o.MaxAttempts != 0 {
+			p.MaxAttempts = o.MaxAttempts
+		}
+		if o.InitialBackoff != 0 {
+			p.InitialBackoff = o.InitialBackoff
+		}
+		if o.MaxBackoff != 0 {
+			p.MaxBackoff = o.MaxBackoff
+		}
+		if o.Jitter != 0 {
+			p.Jitter = o.Jitter
+		}
+	}
+	if p.MaxAttempts == 0 {
+		p.MaxAttempts = defaultMaxAttempts
+	}
+	if p.InitialBackoff <= 0 {
+		p.InitialBackoff = defaultInitialBackoff
+	}
+	if p.MaxBackoff <= 0 {
+		p.MaxBackoff = defaultMaxBackoff
+	}
+	if p.MaxBackoff < p.InitialBackoff {
+		p.MaxBackoff = p.InitialBackoff
+	}
+	if p.Jitter <= 0 {
+		p.Jitter = defaultJitter
+	}
+	return p
+}
+
+// Do calls f until it succeeds, fails with error not retryable, or MaxAttempts is reached.
+// Negative MaxAttempts disables retry. The last error is returned.
+func (p *Policy) Do(ctx context.Context, f func() error) error {
+	retryable := p.Retryable
+	if retryable == nil {
+		retryable = IsRetryable
+	}
+	backoff := p.InitialBackoff
+	for attempt := 1; ; attempt++ {
+		err := f()
+		if err == nil || !retryable(err) || attempt >= p.MaxAttempts {
+			return err
+		}
+		wait := p.jitter(backoff)
+		if after, ok := RetryAfter(err); ok && after > wait {
+			wait = after
+		}
+		if deadline, ok := ctx.Deadline(); ok && time.Until(deadline) < wait {
+			// waiting is useless
+			return err
+		}
+		select {
+		case <-ctx.Done():
+			return err
+		case <-time.After(wait):
+		}
+		if backoff *= 2; backoff > p.MaxBackoff {
+			backoff = p.MaxBackoff
+		}
+	}
+}
+
+func (p *Policy) jitter(d time.Duration) time.Duration {
+	delta := (rand.Float64()*2 - 1) * p.Jitter * float64(d)
+	return d + time.Duration(delta)
+}
+
+// IsRetryable reports whether err is rate limit, server error or temporary network error
+// of Calendar API or Firestore
+func IsRetryable(err error) bool {
+	if err == nil {
+		return false
+	}
+	var rerr *RetryAfterError
+	if errors.As(err, &rerr) {
+		return true
+	}
+	var gerr *googleapi.Error
+	if errors.As(err, &gerr) {
+		switch {
+		case gerr.Code == http.StatusTooManyRequests, gerr.Code >= 500:
+			return true
+		case gerr.Code == http.StatusForbidden:
+			return IsRateLimited(gerr)
+		}
+		return false
+	}
+	var serr interface{ GRPCStatus() *status.Status }
+	if errors.As(err, &serr) {
+		switch serr.GRPCStatus().Code() {
+		case codes.Unavailable, codes.ResourceExhausted, codes.Aborted, codes.Internal, codes.DeadlineExceeded:
+			return true
+		}
+		return false
+	}
+	var t interface{ Temporary() bool }
+	return errors.As(err, &t) && t.Temporary()
+}
+
+// IsRateLimited means quota exceeded, which Calendar API responds with 403
+func IsRateLimited(gerr *googleapi.Error) bool {
+	for _, item := range gerr.Errors {
+		switch item.Reason {
+		case "rateLimitExceeded", "userRateLimitExceeded":
+			return true
+		}
+	}
+	return false
+}
+
+// RetryAfter returns wait requested by Retry-After header of the response, in seconds or HTTP date
+func RetryAfter(err error) (time.Duration, bool) {
+	var rerr *RetryAfterError
+	if errors.As(err, &rerr) {
+		return rerr.After, true
+	}
+	var gerr *googleapi.Error
+	if errors.As(err, &gerr) && gerr.Header != nil {
+		return parseRetryAfter(gerr.Header.Get("Retry-After"))
+	}
+	return 0, false
+}
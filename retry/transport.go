@@ -0,0 +1,101 @@
+package retry
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"time"
+
+	"google.golang.org/api/googleapi"
+)
+
+// RetryAfterError is a response requesting to retry later with Retry-After header.
+// googleapi drops headers of JSON error responses, so Transport keeps it in this error.
+type RetryAfterError struct {
+	StatusCode int
+	After      time.Duration
+	Body       string
+}
+
+func (e *RetryAfterError) Error() string {
+	return fmt.Sprintf("status %d, retry after %s: %s", e.StatusCode, e.After, e.Body)
+}
+
+// Transport turns responses of rate limit and server error with Retry-After header into RetryAfterError.
+// 403 is turned only when its reason is rate limit.
+type Transport struct {
+	// Base is http.DefaultTransport if nil
+	Base http.RoundTripper
+}
+
+func (t *Transport) RoundTrip(req *http.Request) (*http.Response, error) {
+	base := t.Base
+	if base == nil {
+		base = http.DefaultTransport
+	}
+	res, err := base.RoundTrip(req)
+	if err != nil {
+		return nil, err
+	}
+	if res.StatusCode != http.StatusTooManyRequests && res.StatusCode != http.StatusForbidden && res.StatusCode < 500 {
+		return res, nil
+	}
+	after, ok := parseRetryAfter(res.Header.Get("Retry-After"))
+	if !ok {
+		return res, nil
+	}
+	body, err := ioutil.ReadAll(io.LimitReader(res.Body, 1<<16))
+	if err != nil {
+		res.Body.Close()
+		return nil, err
+	}
+	if res.StatusCode == http.StatusForbidden && !isRateLimitBody(res, body) {
+		// 403 is also missing permission, which never succeeds by retry. Give the body back to caller.
+		res.Body = readCloser{io.MultiReader(bytes.NewReader(body), res.Body), res.Body}
+		return res, nil
+	}
+	res.Body.Close()
+	return nil, &RetryAfterError{StatusCode: res.StatusCode, After: after, Body: string(body)}
+}
+
+type readCloser struct {
+	io.Reader
+	io.Closer
+}
+
+// isRateLimitBody reads reason of error in body of 403 response, as googleapi does
+func isRateLimitBody(res *http.Response, body []byte) bool {
+	err := googleapi.CheckResponse(&http.Response{
+		StatusCode: res.StatusCode,
+		Header:     res.Header,
+		Body:       ioutil.NopCloser(bytes.NewReader(body)),
+	})
+	var gerr *googleapi.Error
+	return errors.As(err, &gerr) && IsRateLimited(gerr)
+}
+
+// parseRetryAfter reads seconds or HTTP date
+func parseRetryAfter(v string) (time.Duration, bool) {
+	if v == "" {
+		return 0, false
+	}
+	var d time.Duration
+	if secs, err := strconv.Atoi(v); err == nil {
+		d = time.Duration(secs) * time.Second
+	} else if t, err := http.ParseTime(v); err == nil {
+		d = time.Until(t)
+	} else {
+		return 0, false
+	}
+	if d < 0 {
+		d = 0
+	}
+	if d > maxRetryAfter {
+		d = maxRetryAfter
+	}
+	return d, true
+}
@@ -0,0 +1,255 @@
+package retry
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"google.golang.org/api/googleapi"
+)
+
+const (
+	rateLimitBody  = `{"error":{"code":403,"message":"Rate Limit Exceeded","errors":[{"reason":"rateLimitExceeded"}]}}`
+	forbiddenBody  = `{"error":{"code":403,"message":"Forbidden","errors":[{"reason":"forbidden"}]}}`
+	badRequestBody = `{"error":{"code":400,"message":"Bad Request","errors":[{"reason":"badRequest"}]}}`
+)
+
+// response is one response of fakeServer
+type response struct {
+	status     int
+	retryAfter string
+	body       string
+}
+
+// fakeServer responds responses in order and 200 after them, recording bodies of requests
+type fakeServer struct {
+	*httptest.Server
+	mu        sync.Mutex
+	responses []response
+	bodies    []string
+}
+
+func newFakeServer(t *testing.T, responses ...response) *fakeServer {
+	s := &fakeServer{responses: responses}
+	s.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b, _ := ioutil.ReadAll(r.Body)
+		s.mu.Lock()
+		s.bodies = append(s.bodies, string(b))
+		res := response{status: http.StatusOK, body: "{}"}
+		if len(s.responses) > 0 {
+			res, s.responses = s.responses[0], s.responses[1:]
+		}
+		s.mu.Unlock()
+		if res.retryAfter != "" {
+			w.Header().Set("Retry-After", res.retryAfter)
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(res.status)
+		w.Write([]byte(res.body))
+	}))
+	t.Cleanup(s.Close)
+	return s
+}
+
+func (s *fakeServer) requests() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]string{}, s.bodies...)
+}
+
+func testPolicy() *Policy {
+	return &Policy{MaxAttempts: 4, InitialBackoff: time.Millisecond, MaxBackoff: 4 * time.Millisecond, Jitter: 0.1}
+}
+
+// call posts body through Transport and fails like googleapi does for error status
+func call(srv *fakeServer, body string) error {
+	req, err := http.NewRequest(http.MethodPost, srv.URL, strings.NewReader(body))
+	if err != nil {
+		return err
+	}
+	res, err := (&http.Client{Transport: &Transport{}}).Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	return googleapi.CheckResponse(res)
+}
+
+func TestRetryStatus(t *testing.T) {
+	for _, tt := range []struct {
+		name     string
+		res      response
+		attempts int
+	}{
+		{"too many requests", response{status: http.StatusTooManyRequests, body: "{}"}, 2},
+		{"server error", response{status: http.StatusInternalServerError, body: "{}"}, 2},
+		{"unavailable", response{status: http.StatusServiceUnavailable, body: "{}"}, 2},
+		{"rate limit by 403", response{status: http.StatusForbidden, body: rateLimitBody}, 2},
+		{"rate limit by 403 with Retry-After", response{status: http.StatusForbidden, retryAfter: "0", body: rateLimitBody}, 2},
+		{"forbidden", response{status: http.StatusForbidden, body: forbiddenBody}, 1},
+		{"forbidden with Retry-After", response{status: http.StatusForbidden, retryAfter: "0", body: forbiddenBody}, 1},
+		{"bad request", response{status: http.StatusBadRequest, body: badRequestBody}, 1},
+		{"not found", response{status: http.StatusNotFound, retryAfter: "0", body: "{}"}, 1},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			srv := newFakeServer(t, tt.res)
+			err := testPolicy().Do(context.Background(), func() error {
+				return call(srv, "event")
+			})
+			if n := len(srv.requests()); n != tt.attempts {
+				t.Errorf("attempts: want %d, got %d", tt.attempts, n)
+			}
+			if tt.attempts > 1 && err != nil {
+				t.Errorf("want success after retry, got %s", err)
+			}
+			if tt.attempts == 1 && err == nil {
+				t.Error("want error without retry")
+			}
+		})
+	}
+}
+
+func TestForbiddenKeepsBody(t *testing.T) {
+	srv := newFakeServer(t, response{status: http.StatusForbidden, retryAfter: "1", body: forbiddenBody})
+	err := call(srv, "event")
+	var gerr *googleapi.Error
+	if !errors.As(err, &gerr) {
+		t.Fatalf("want googleapi.Error, got %v", err)
+	}
+	if gerr.Code != http.StatusForbidden || len(gerr.Errors) != 1 || gerr.Errors[0].Reason != "forbidden" {
+		t.Errorf("want reason forbidden, got %+v", gerr)
+	}
+	if IsRetryable(err) {
+		t.Error("forbidden should not be retryable")
+	}
+}
+
+func TestRetryAfterSeconds(t *testing.T) {
+	srv := newFakeServer(t, response{status: http.StatusTooManyRequests, retryAfter: "1", body: "{}"})
+	start := time.Now()
+	err := testPolicy().Do(context.Background(), func() error {
+		return call(srv, "event")
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if elapsed := time.Since(start); elapsed < time.Second {
+		t.Errorf("want wait of Retry-After, got %s", elapsed)
+	}
+}
+
+func TestRetryAfterDate(t *testing.T) {
+	at := time.Now().Add(2 * time.Second).UTC()
+	srv := newFakeServer(t, response{status: http.StatusServiceUnavailable, retryAfter: at.Format(http.TimeFormat), body: "{}"})
+	err := testPolicy().Do(context.Background(), func() error {
+		return call(srv, "event")
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// HTTP date is in seconds
+	if now := time.Now(); now.Before(at.Truncate(time.Second)) {
+		t.Errorf("want retry after %s, retried at %s", at, now)
+	}
+}
+
+func TestRetryAfterError(t *testing.T) {
+	srv := newFakeServer(t, response{status: http.StatusTooManyRequests, retryAfter: "7", body: "slow down"})
+	err := call(srv, "event")
+	var rerr *RetryAfterError
+	if !errors.As(err, &rerr) {
+		t.Fatalf("want RetryAfterError, got %v", err)
+	}
+	if rerr.After != 7*time.Second || rerr.Body != "slow down" {
+		t.Errorf("unexpected %+v", rerr)
+	}
+	// too long wait is capped
+	after, ok := parseRetryAfter("86400")
+	if !ok || after != maxRetryAfter {
+		t.Errorf("want %s, got %s", maxRetryAfter, after)
+	}
+	if _, ok := parseRetryAfter("soon"); ok {
+		t.Error("want invalid Retry-After ignored")
+	}
+}
+
+func TestGiveUp(t *testing.T) {
+	unavailable := response{status: http.StatusServiceUnavailable, body: "{}"}
+	srv := newFakeServer(t, unavailable, unavailable, unavailable, unavailable, unavailable)
+	err := testPolicy().Do(context.Background(), func() error {
+		return call(srv, "event")
+	})
+	var gerr *googleapi.Error
+	if !errors.As(err, &gerr) || gerr.Code != http.StatusServiceUnavailable {
+		t.Errorf("want the last error, got %v", err)
+	}
+	if n := len(srv.requests()); n != 4 {
+		t.Errorf("attempts: want 4, got %d", n)
+	}
+
+	srv = newFakeServer(t, unavailable)
+	p := testPolicy()
+	p.MaxAttempts = -1
+	if err := p.Do(context.Background(), func() error { return call(srv, "event") }); err == nil {
+		t.Error("want error with retry disabled")
+	}
+	if n := len(srv.requests()); n != 1 {
+		t.Errorf("attempts with retry disabled: want 1, got %d", n)
+	}
+}
+
+func TestGiveUpBeforeDeadline(t *testing.T) {
+	srv := newFakeServer(t, response{status: http.StatusTooManyRequests, retryAfter: "60", body: "{}"})
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	start := time.Now()
+	if err := testPolicy().Do(ctx, func() error { return call(srv, "event") }); err == nil {
+		t.Error("want error")
+	}
+	if elapsed := time.Since(start); elapsed > 500*time.Millisecond {
+		t.Errorf("want no wait beyond deadline, got %s", elapsed)
+	}
+}
+
+// TestRetryResendsBody makes sure body of request is sent again on retry, as googleapi calls rebuild it
+func TestRetryResendsBody(t *testing.T) {
+	unavailable := response{status: http.StatusServiceUnavailable, retryAfter: "0", body: "{}"}
+	srv := newFakeServer(t, unavailable, unavailable)
+	req, err := http.NewRequest(http.MethodPost, srv.URL, bytes.NewReader([]byte(`{"summary":"block"}`)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	cli := &http.Client{Transport: &Transport{}}
+	err = testPolicy().Do(context.Background(), func() error {
+		body, err := req.GetBody()
+		if err != nil {
+			return err
+		}
+		req.Body = body
+		res, err := cli.Do(req)
+		if err != nil {
+			return err
+		}
+		defer res.Body.Close()
+		return googleapi.CheckResponse(res)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	bodies := srv.requests()
+	if len(bodies) != 3 {
+		t.Fatalf("attempts: want 3, got %d", len(bodies))
+	}
+	for i, b := range bodies {
+		if b != `{"summary":"block"}` {
+			t.Errorf("body of attempt %d: %q", i+1, b)
+		}
+	}
+}
@@ -0,0 +1,119 @@
+package scheduler
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseInvalid(t *testing.T) {
+	for _, spec := range []string{
+		"",
+		"* * * *",
+		"* * * * * *",
+		"@yearly",
+		"60 * * * *",
+		"* 24 * * *",
+		"* * 0 * *",
+		"* * 32 * *",
+		"* * * 0 *",
+		"* * * 13 *",
+		"* * * * 8",
+		"5-1 * * * *",
+		"*/0 * * * *",
+		"*/x * * * *",
+		"1-x * * * *",
+		"a * * * *",
+		"1,,2 * * * *",
+		"-1 * * * *",
+	} {
+		if _, err := Parse(spec); err == nil {
+			t.Errorf("%q: want error", spec)
+		}
+	}
+}
+
+func TestNext(t *testing.T) {
+	tokyo, err := time.LoadLocation("Asia/Tokyo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	at := func(s string) time.Time {
+		v, err := time.ParseInLocation("2006-01-02 15:04", s, tokyo)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return v
+	}
+	// 2021-08-01 is Sunday
+	for _, tt := range []struct {
+		spec string
+		from string
+		want []string
+	}{
+		{"* * * * *", "2021-08-01 10:00", []string{"2021-08-01 10:01", "2021-08-01 10:02"}},
+		{"*/15 * * * *", "2021-08-01 10:07", []string{"2021-08-01 10:15", "2021-08-01 10:30", "2021-08-01 10:45", "2021-08-01 11:00"}},
+		{"5/20 * * * *", "2021-08-01 10:00", []string{"2021-08-01 10:05", "2021-08-01 10:25", "2021-08-01 10:45", "2021-08-01 11:05"}},
+		{"0-30/10 9 * * *", "2021-08-01 09:25", []string{"2021-08-01 09:30", "2021-08-02 09:00"}},
+		{"0 9-11 * * *", "2021-08-01 10:30", []string{"2021-08-01 11:00", "2021-08-02 09:00"}},
+		{"0 8,12,18 * * *", "2021-08-01 12:00", []string{"2021-08-01 18:00", "2021-08-02 08:00"}},
+		{"0 9 * * 1-5", "2021-08-06 10:00", []string{"2021-08-09 09:00"}},
+		{"0 0 * * 7", "2021-08-02 00:00", []string{"2021-08-08 00:00"}},
+		{"0 0 31 * *", "2021-08-31 00:00", []string{"2021-10-31 00:00", "2021-12-31 00:00"}},
+		{"0 0 29 2 *", "2021-03-01 00:00", []string{"2024-02-29 00:00"}},
+		{"0 0 1 */3 *", "2021-08-01 00:00", []string{"2021-10-01 00:00", "2022-01-01 00:00"}},
+		{"@hourly", "2021-08-01 10:00", []string{"2021-08-01 11:00"}},
+		{"@weekly", "2021-08-01 00:00", []string{"2021-08-08 00:00"}},
+		{"@monthly", "2021-08-15 00:00", []string{"2021-09-01 00:00"}},
+		// both day fields restricted: either matches. 2021-08-13 is Friday.
+		{"0 0 13 * 5", "2021-08-01 00:00", []string{"2021-08-06 00:00", "2021-08-13 00:00", "2021-08-20 00:00"}},
+		// only one day field restricted: both must match
+		{"0 0 13 * *", "2021-08-01 00:00", []string{"2021-08-13 00:00", "2021-09-13 00:00"}},
+		{"0 0 * 8 5", "2021-08-21 00:00", []string{"2021-08-27 00:00", "2022-08-05 00:00"}},
+	} {
+		s, err := Parse(tt.spec)
+		if err != nil {
+			t.Errorf("%q: %s", tt.spec, err)
+			continue
+		}
+		next := at(tt.from)
+		for _, w := range tt.want {
+			next = s.Next(next)
+			if want := at(w); !next.Equal(want) {
+				t.Errorf("%q from %s: want %s, got %s", tt.spec, tt.from, want, next)
+				break
+			}
+		}
+	}
+}
+
+func TestNextDST(t *testing.T) {
+	ny, err := time.LoadLocation("America/New_York")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tt := range []struct {
+		name string
+		spec string
+		from time.Time
+		want time.Time
+	}{
+		// 2:30 does not exist on 2021-03-14, so it is skipped to the next day
+		{"skipped hour", "30 2 * * *", time.Date(2021, 3, 14, 0, 0, 0, 0, ny), time.Date(2021, 3, 15, 2, 30, 0, 0, ny)},
+		{"after skipped hour", "0 3 * * *", time.Date(2021, 3, 14, 1, 59, 0, 0, ny), time.Date(2021, 3, 14, 3, 0, 0, 0, ny)},
+		{"hourly over spring forward", "0 * * * *", time.Date(2021, 3, 14, 1, 30, 0, 0, ny), time.Date(2021, 3, 14, 3, 0, 0, 0, ny)},
+		{"daily keeps wall clock", "0 9 * * *", time.Date(2021, 11, 6, 9, 0, 0, 0, ny), time.Date(2021, 11, 7, 9, 0, 0, 0, ny)},
+		// 1:30 occurs twice on 2021-11-07, in EDT and then in EST
+		{"repeated hour", "30 1 * * *", time.Date(2021, 11, 7, 1, 30, 0, 0, ny), time.Date(2021, 11, 7, 1, 30, 0, 0, ny).Add(time.Hour)},
+	} {
+		s, err := Parse(tt.spec)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := s.Next(tt.from); !got.Equal(tt.want) {
+			t.Errorf("%s: want %s, got %s", tt.name, tt.want, got)
+		}
+		if got := s.Next(tt.from); got.Location() != ny {
+			t.Errorf("%s: want location of from, got %s", tt.name, got.Location())
+		}
+	}
+}
@@ -0,0 +1,103 @@
+package scheduler
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/google/uuid"
+
+	"github.com/shiraily/gcal-sync/logging"
+)
+
+// Lease is held by the instance running a job. StateStore satisfies it.
+type Lease interface {
+	AcquireLock(ctx context.Context, name string, owner string, ttl time.Duration) (bool, error)
+}
+
+type job struct {
+	name     string
+	schedule *Schedule
+	run      func(ctx context.Context) error
+}
+
+// Scheduler runs jobs on cron schedule. When several instances are deployed,
+// only the one taking the lease runs each occurrence of a job.
+type Scheduler struct {
+	lease    Lease
+	location *time.Location
+	instance string
+	jobs     []job
+}
+
+func New(lease Lease, location *time.Location) *Scheduler {
+	if location == nil {
+		location = time.Local
+	}
+	host, _ := os.Hostname()
+	return &Scheduler{
+		lease:    lease,
+		location: location,
+		instance: host + "-" + uuid.New().String(),
+	}
+}
+
+// Add registers job. Empty spec disables the job.
+func (s *Scheduler) Add(name string, spec string, run func(ctx context.Context) error) error {
+	if spec == "" {
+		return nil
+	}
+	schedule, err := Parse(spec)
+	if err != nil {
+		return fmt.Errorf("job %s: %s", name, err)
+	}
+	s.jobs = append(s.jobs, job{name: name, schedule: schedule, run: run})
+	return nil
+}
+
+// Run runs jobs until ctx is done
+func (s *Scheduler) Run(ctx context.Context) {
+	for _, j := range s.jobs {
+		go s.loop(ctx, j)
+	}
+	<-ctx.Done()
+}
+
+func (s *Scheduler) loop(ctx context.Context, j job) {
+	for {
+		next := j.schedule.Next(time.Now().In(s.location))
+		if next.IsZero() {
+			logging.Warn("job never runs", "job", j.name)
+			return
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(time.Until(next)):
+		}
+		s.runOnce(ctx, j, next)
+	}
+}
+
+// runOnce keeps the lease until just before the next occurrence, so that instances
+// with clock skew do not run the same occurrence after this one finishes
+func (s *Scheduler) runOnce(ctx context.Context, j job, scheduled time.Time) {
+	ttl := j.schedule.Next(scheduled).Sub(scheduled) * 9 / 10
+	owner := fmt.Sprintf("%s@%d", s.instance, scheduled.Unix())
+	ok, err := s.lease.AcquireLock(ctx, "job:"+j.name, owner, ttl)
+	if err != nil {
+		logging.Error("job lease", "job", j.name, "error", err)
+		return
+	}
+	if !ok {
+		logging.Info("job is run by another instance", "job", j.name)
+		return
+	}
+	started := time.Now()
+	if err := j.run(ctx); err != nil {
+		logging.Error("job failed", "job", j.name, "error", err)
+		return
+	}
+	logging.Info("job done", "job", j.name, "duration", time.Since(started))
+}
@@ -0,0 +1,105 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/shiraily/gcal-sync/config"
+	"github.com/shiraily/gcal-sync/health"
+	"github.com/shiraily/gcal-sync/logging"
+	"github.com/shiraily/gcal-sync/store"
+)
+
+// readinessChecks lists dependencies checked by /readyz. Only local ones fail it. Channels are
+// reported as optional, since restarting instance does not fix them.
+func readinessChecks() []health.Check {
+	conf := pool.Config()
+	tenantIds := tenantIdsOf(conf)
+	checks := []health.Check{
+		{Name: "config", Run: func(ctx context.Context) error {
+			// file may have been broken after loaded
+			conf, err := config.Load(pool.Path())
+			if err != nil {
+				return err
+			}
+			return conf.Validate()
+		}},
+		{Name: "credentials", Run: func(ctx context.Context) error {
+			return pool.CheckCredentials()
+		}},
+		{Name: "store", Run: func(ctx context.Context) error {
+			_, err := pool.Store().ReadToken(ctx, tenantIds[0])
+			return err
+		}},
+	}
+	if conf.Mode == "poll" {
+		return checks
+	}
+	states := channelStates()
+	for _, id := range tenantIds {
+		st, ok := states[id]
+		checks = append(checks, health.Check{Name: "channel:" + id, Optional: true, Run: func(ctx context.Context) error {
+			if !ok {
+				return errors.New("channels not read yet")
+			}
+			return st.problem
+		}})
+	}
+	return checks
+}
+
+// channelCacheTTL is how long channels read from state store are reused by probes and metrics
+const channelCacheTTL = time.Minute
+
+// channelState is the active channel of a tenant and why it does not work well, if any
+type channelState struct {
+	active  *store.Channel
+	problem error
+}
+
+var channelCache struct {
+	sync.Mutex
+	checked time.Time
+	states  map[string]channelState
+}
+
+// channelStates reads channels of all tenants from state store at most once in channelCacheTTL.
+// Tenants whose channels fail to be read are omitted.
+func channelStates() map[string]channelState {
+	channelCache.Lock()
+	defer channelCache.Unlock()
+	if time.Since(channelCache.checked) < channelCacheTTL {
+		return channelCache.states
+	}
+	states := map[string]channelState{}
+	for _, id := range tenantIdsOf(pool.Config()) {
+		cli, err := pool.Client(id)
+		if err != nil {
+			continue
+		}
+		ch, err := cli.ActiveChannel()
+		if err != nil {
+			logging.Warn("read active channel", "tenant", id, "error", err)
+			continue
+		}
+		states[id] = channelState{active: ch, problem: cli.CheckActive(ch)}
+	}
+	channelCache.checked, channelCache.states = time.Now(), states
+	return states
+}
+
+// channelExpirations is exported as metrics. Tenants without confirmed channel are omitted.
+func channelExpirations() map[string]time.Time {
+	exps := map[string]time.Time{}
+	if pool.Config().Mode == "poll" {
+		return exps
+	}
+	for id, st := range channelStates() {
+		if st.active != nil && st.active.Expiration != 0 {
+			exps[id] = st.active.ExpiresAt()
+		}
+	}
+	return exps
+}
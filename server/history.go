@@ -0,0 +1,37 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+
+	"github.com/shiraily/gcal-sync/calendar"
+	"github.com/shiraily/gcal-sync/logging"
+)
+
+// OnHistory responds runs and actions of the tenant as JSON. event and block parameters
+// narrow them to one source event or one block, which answers why the block exists.
+func OnHistory(w http.ResponseWriter, r *http.Request) {
+	params := r.URL.Query()
+	cli, err := pool.Client(params.Get("tenant"))
+	if err != nil {
+		logging.Warn("history", "error", err)
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	limit, _ := strconv.Atoi(params.Get("limit"))
+	h, err := cli.WithContext(r.Context()).History(calendar.HistoryQuery{
+		SrcEventId:  params.Get("event"),
+		DestEventId: params.Get("block"),
+		Limit:       limit,
+	})
+	if err != nil {
+		logging.Error("history", "tenant", cli.TenantId(), "error", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(h); err != nil {
+		logging.Error("history", "error", err)
+	}
+}
@@ -0,0 +1,94 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/shiraily/gcal-sync/calendar"
+	"github.com/shiraily/gcal-sync/config"
+	"github.com/shiraily/gcal-sync/logging"
+	"github.com/shiraily/gcal-sync/scheduler"
+)
+
+const (
+	defaultRunRetention = 30 * 24 * time.Hour
+	reportPeriod        = 24 * time.Hour
+)
+
+// startScheduler runs jobs set in schedule of env.yaml, so that no Cloud Scheduler is needed.
+// The returned func stops it.
+func startScheduler(conf *config.Config) (func(), error) {
+	sc := conf.Schedule
+	if sc.Renew == "" && sc.Reconcile == "" && sc.Cleanup == "" && sc.Report == "" {
+		return func() {}, nil
+	}
+	loc := time.Local
+	if sc.TimeZone != "" {
+		var err error
+		if loc, err = time.LoadLocation(sc.TimeZone); err != nil {
+			return nil, fmt.Errorf("schedule time zone: %s", err)
+		}
+	}
+	s := scheduler.New(pool.Store(), loc)
+	retention := sc.RunRetention
+	if retention <= 0 {
+		retention = defaultRunRetention
+	}
+	jobs := []struct {
+		name string
+		spec string
+		run  func(cli *calendar.Client) error
+	}{
+		{"renew", sc.Renew, func(cli *calendar.Client) error {
+			return cli.MaintainChannels()
+		}},
+		{"reconcile", sc.Reconcile, func(cli *calendar.Client) error {
+			n, err := cli.Reconcile()
+			logging.Info("reconciled blocks", "tenant", cli.TenantId(), "fixed", n)
+			return err
+		}},
+		{"cleanup", sc.Cleanup, func(cli *calendar.Client) error {
+			n, err := cli.Cleanup(time.Now().Add(-retention))
+			logging.Info("deleted runs", "tenant", cli.TenantId(), "deleted", n)
+			return err
+		}},
+		{"report", sc.Report, func(cli *calendar.Client) error {
+			r, err := cli.Report(time.Now().Add(-reportPeriod))
+			if err != nil {
+				return err
+			}
+			logging.Info("report", "tenant", r.TenantId, "since", r.Since.Format(time.RFC3339), "runs", r.Runs,
+				"failed", r.Failed, "created", r.Created, "failed_events", r.FailedEvents, "last_error", r.LastError)
+			return nil
+		}},
+	}
+	for _, j := range jobs {
+		j := j
+		if err := s.Add(j.name, j.spec, func(ctx context.Context) error {
+			return forEachTenant(j.run)
+		}); err != nil {
+			return nil, err
+		}
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	go s.Run(ctx)
+	return cancel, nil
+}
+
+// forEachTenant runs f for all tenants even if some fail, and returns the last error
+func forEachTenant(f func(cli *calendar.Client) error) error {
+	var lastErr error
+	for _, id := range tenantIdsOf(pool.Config()) {
+		cli, err := pool.Client(id)
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		if err := f(cli); err != nil {
+			logging.Error("job failed", "tenant", id, "error", err)
+			lastErr = err
+		}
+	}
+	return lastErr
+}
@@ -0,0 +1,52 @@
+package server
+
+import (
+	"sync"
+
+	"github.com/shiraily/gcal-sync/config"
+)
+
+// runners keeps stop funcs of pollers, channel manager and scheduler running for the current config,
+// since reload and shutdown change them from different goroutines
+type runners struct {
+	mu                 sync.Mutex
+	stopPollers        func()
+	stopChannelManager func()
+	stopScheduler      func()
+}
+
+// start stops runners of the previous config and starts ones of conf, so that switching mode on
+// reload stops pollers and starts channel manager, or the other way around.
+// Pollers and channel manager are running even if scheduler fails to start.
+func (r *runners) start(conf *config.Config) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.stopLocked()
+	if conf.Mode == "poll" {
+		r.stopPollers = startPollers(conf)
+	} else {
+		r.stopChannelManager = startChannelManager(conf)
+	}
+	stop, err := startScheduler(conf)
+	if err != nil {
+		return err
+	}
+	r.stopScheduler = stop
+	return nil
+}
+
+// stop stops all runners
+func (r *runners) stop() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.stopLocked()
+}
+
+func (r *runners) stopLocked() {
+	for _, stop := range []*func(){&r.stopPollers, &r.stopChannelManager, &r.stopScheduler} {
+		if *stop != nil {
+			(*stop)()
+			*stop = nil
+		}
+	}
+}
@@ -0,0 +1,348 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/google/uuid"
+	"go.opentelemetry.io/otel/attribute"
+
+	"github.com/shiraily/gcal-sync/auth"
+	"github.com/shiraily/gcal-sync/calendar"
+	"github.com/shiraily/gcal-sync/config"
+	"github.com/shiraily/gcal-sync/health"
+	"github.com/shiraily/gcal-sync/logging"
+	"github.com/shiraily/gcal-sync/metrics"
+	"github.com/shiraily/gcal-sync/poll"
+	"github.com/shiraily/gcal-sync/queue"
+	"github.com/shiraily/gcal-sync/tracing"
+)
+
+// shutdownTimeout bounds waiting for requests in flight and flushing traces on SIGTERM
+const shutdownTimeout = 10 * time.Second
+
+var (
+	// pool keeps clients built at startup for all requests
+	pool *calendar.Pool
+	// jobs processes notifications after acknowledging them
+	jobs queue.Queue
+	// background runs pollers, channel manager and scheduler of the current config
+	background = &runners{}
+)
+
+// Serve runs the webhook server with config file at configPath until SIGTERM or interrupt,
+// and then shuts it down gracefully. dryRun only logs writes to calendars and state store.
+func Serve(configPath string, dryRun bool) {
+	var err error
+	pool, err = calendar.NewPool(context.Background(), configPath)
+	if err != nil {
+		logging.Fatal("create clients", "error", err)
+	}
+	pool.SetDryRun(dryRun)
+	conf := pool.Config()
+	if err := logging.Configure(conf.Log); err != nil {
+		logging.Fatal("configure log", "error", err)
+	}
+	pool.OnReload(func(conf *config.Config) {
+		if err := logging.Configure(conf.Log); err != nil {
+			logging.Error("configure log", "error", err)
+		}
+	})
+	shutdownTracing, err := tracing.Setup(context.Background(), conf.Trace)
+	if err != nil {
+		logging.Fatal("set up tracing", "error", err)
+	}
+	if jobs, err = queue.Open(context.Background(), conf, runJob); err != nil {
+		logging.Fatal("open queue", "error", err)
+	}
+	verifier := auth.NewVerifier(conf.Auth)
+	if err := background.start(conf); err != nil {
+		logging.Fatal("start scheduler", "error", err)
+	}
+	pool.OnReload(func(conf *config.Config) {
+		if err := background.start(conf); err != nil {
+			logging.Error("restart scheduler", "error", err)
+		}
+	})
+	go reloadOnSignal()
+
+	http.HandleFunc("/notify", OnNotify)
+	http.HandleFunc("/renew", verifier.Protect(OnRenew))
+	http.HandleFunc("/healthz", health.LiveHandler)
+	http.HandleFunc("/readyz", health.ReadyHandler(readinessChecks))
+	metrics.RegisterChannelExpiry(channelExpirations)
+	http.HandleFunc("/metrics", verifier.Protect(metrics.Handler().ServeHTTP))
+	http.HandleFunc("/history", verifier.Protect(OnHistory))
+	http.HandleFunc("/status", verifier.Protect(OnStatus))
+	http.HandleFunc("/tasks", verifier.Protect(queue.PushHandler(runJob)))
+
+	port := os.Getenv("PORT")
+	if port == "" {
+		port = "3000"
+		logging.Info("defaulting to port", "port", port)
+	}
+
+	srv := &http.Server{Addr: ":" + port}
+	stopped := make(chan struct{})
+	go shutdownOnTerm(srv, stopped)
+	logging.Info("listening", "port", port)
+	if err := srv.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+		logging.Fatal("serve", "error", err)
+	}
+	// ListenAndServe returns as soon as shutdown starts
+	<-stopped
+
+	// requests have finished, so no job is enqueued anymore
+	background.stop()
+	if err := jobs.Close(); err != nil {
+		logging.Error("close queue", "error", err)
+	}
+	// spans of the jobs drained are exported
+	ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+	if err := shutdownTracing(ctx); err != nil {
+		logging.Error("flush traces", "error", err)
+	}
+	if err := pool.Close(); err != nil {
+		logging.Error("close state store", "error", err)
+	}
+	logging.Info("server stopped")
+}
+
+// OnNotify acknowledges push notification immediately and leaves sync to the queue.
+// Logs of the notification and the sync job share its correlation id.
+func OnNotify(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain")
+	channelId := r.Header.Get("X-Goog-Channel-Id")
+	state := r.Header.Get("X-Goog-Resource-State")
+	correlationId := uuid.New().String()
+	ctx, span := tracing.Start(r.Context(), "notify",
+		attribute.String("channel_id", channelId), attribute.String("state", state))
+	defer span.End()
+	ctx = logging.WithFields(ctx, "correlation_id", correlationId, "channel_id", channelId)
+	logger := logging.FromContext(ctx)
+	cli, err := pool.Client(r.URL.Query().Get("tenant"))
+	if err != nil {
+		logger.Warn("notify", "error", err)
+		tracing.Fail(span, err)
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	cli = cli.WithContext(ctx)
+	logger = logger.With("tenant", cli.TenantId())
+	logger.Info("notification received", "state", state, "resource_id", r.Header.Get("X-Goog-Resource-Id"))
+	metrics.NotificationsReceived.WithLabelValues(stateLabel(state)).Inc()
+	if err := cli.VerifyChannel(channelId, r.Header.Get("X-Goog-Channel-Token")); calendar.IsTransient(err) {
+		logger.Error("verify channel", "error", err)
+		tracing.Fail(span, err)
+		// let Google retry
+		w.WriteHeader(http.StatusServiceUnavailable)
+		return
+	} else if err != nil {
+		metrics.NotificationsRejected.Inc()
+		logger.Warn("rejected notification", "error", err)
+		tracing.Fail(span, err)
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
+	span.SetAttributes(attribute.String("tenant", cli.TenantId()))
+	job := queue.Job{TenantId: cli.TenantId(), CorrelationId: correlationId, Trace: tracing.Inject(ctx)}
+	switch state {
+	case "sync":
+		// handshake of new channel. gets the first token if none exists
+		if err := cli.ConfirmChannel(channelId); err != nil {
+			logger.Error("confirm channel", "error", err)
+		}
+		job.Kind = queue.KindInitial
+	case "exists":
+		job.Kind = queue.KindSync
+	case "not_exists":
+		logger.Warn("watched calendar does not exist")
+		w.WriteHeader(http.StatusOK)
+		return
+	case "":
+		logger.Warn("no resource state")
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	default:
+		// acknowledge not to be retried
+		logger.Warn("unknown resource state", "state", state)
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+	if err := jobs.Enqueue(r.Context(), job); err != nil {
+		logger.Error("enqueue", "error", err)
+		tracing.Fail(span, err)
+		// let Google retry
+		w.WriteHeader(http.StatusServiceUnavailable)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+}
+
+// stateLabel keeps label values of metrics bounded
+func stateLabel(state string) string {
+	switch state {
+	case "sync", "exists", "not_exists":
+		return state
+	case "":
+		return "none"
+	}
+	return "unknown"
+}
+
+// runJob syncs the tenant in the job
+func runJob(ctx context.Context, job queue.Job) (err error) {
+	ctx, span := tracing.Start(tracing.Extract(ctx, job.Trace), "job."+job.Kind,
+		attribute.String("tenant", job.TenantId), attribute.Int("attempt", job.Attempt))
+	defer func() { tracing.End(span, err) }()
+	cli, err := pool.Client(job.TenantId)
+	if err != nil {
+		// tenant was removed from env.yaml
+		return &calendar.Error{Op: "run job", Err: err}
+	}
+	if job.CorrelationId != "" {
+		ctx = logging.WithFields(ctx, "correlation_id", job.CorrelationId)
+	}
+	cli = cli.WithContext(ctx).WithTrigger(calendar.TriggerNotification)
+	if job.Kind == queue.KindSync {
+		return cli.Sync()
+	}
+	return cli.SyncInitial()
+}
+
+// OnRenew runs channel manager of all tenants, or only the one given by tenant parameter.
+// Other tenants are still renewed when one fails, and the response lists result of each.
+// It responds 503 if any failure is transient so that scheduler retries, and 500 otherwise.
+func OnRenew(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain")
+	tenantIds := []string{r.URL.Query().Get("tenant")}
+	if tenantIds[0] == "" {
+		tenantIds = tenantIdsOf(pool.Config())
+	} else if _, err := pool.Config().GetTenant(tenantIds[0]); err != nil {
+		logging.Warn("renew", "error", err)
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	status := http.StatusOK
+	var lines []string
+	for _, id := range tenantIds {
+		err := maintainChannels(id)
+		if err == nil {
+			lines = append(lines, id+": ok")
+			continue
+		}
+		logging.Error("renew watch", "tenant", id, "error", err)
+		lines = append(lines, fmt.Sprintf("%s: %s", id, err))
+		if calendar.IsTransient(err) {
+			status = http.StatusServiceUnavailable
+		} else if status == http.StatusOK {
+			status = http.StatusInternalServerError
+		}
+	}
+	w.WriteHeader(status)
+	if _, err := w.Write([]byte(strings.Join(lines, "\n"))); err != nil {
+		logging.Error("renew", "error", err)
+	}
+}
+
+func maintainChannels(tenantId string) error {
+	cli, err := pool.Client(tenantId)
+	if err != nil {
+		return err
+	}
+	return cli.MaintainChannels()
+}
+
+// startChannelManager maintains channels by timer instead of scheduler calling /renew,
+// if channel.check_interval is set. The returned func stops it.
+func startChannelManager(conf *config.Config) func() {
+	interval := conf.Channel.CheckInterval
+	if interval <= 0 {
+		return func() {}
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+			for _, id := range tenantIdsOf(pool.Config()) {
+				if ctx.Err() != nil {
+					return
+				}
+				if err := maintainChannels(id); err != nil {
+					logging.Error("maintain channels", "tenant", id, "error", err)
+				}
+			}
+		}
+	}()
+	// waits for the running manager, not to change channels after shutdown
+	return func() {
+		cancel()
+		<-done
+	}
+}
+
+// startPollers syncs each tenant on interval instead of push notifications. The returned func stops them.
+func startPollers(conf *config.Config) func() {
+	ctx, cancel := context.WithCancel(context.Background())
+	for _, id := range tenantIdsOf(conf) {
+		id := id
+		p := poll.NewPoller(conf.Poll, id, func() (int, error) {
+			cli, err := pool.Client(id)
+			if err != nil {
+				return 0, err
+			}
+			return cli.Poll()
+		})
+		go p.Run(ctx)
+	}
+	return cancel
+}
+
+// shutdownOnTerm stops accepting requests on SIGTERM and closes stopped after ones in flight finish
+func shutdownOnTerm(srv *http.Server, stopped chan<- struct{}) {
+	defer close(stopped)
+	ch := make(chan os.Signal, 1)
+	signal.Notify(ch, syscall.SIGTERM, os.Interrupt)
+	sig := <-ch
+	logging.Info("shutting down", "signal", sig.String())
+	ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+	if err := srv.Shutdown(ctx); err != nil {
+		logging.Error("shut down server", "error", err)
+	}
+}
+
+// reloadOnSignal reloads env.yaml on SIGHUP without restarting server.
+// Changes of queue and auth are applied on restart.
+func reloadOnSignal() {
+	ch := make(chan os.Signal, 1)
+	signal.Notify(ch, syscall.SIGHUP)
+	for range ch {
+		if err := pool.Reload(); err != nil {
+			logging.Error("reload", "error", err)
+		}
+	}
+}
+
+func tenantIdsOf(conf *config.Config) []string {
+	var ids []string
+	for _, t := range conf.GetTenants() {
+		ids = append(ids, t.Id)
+	}
+	return ids
+}
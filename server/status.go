@@ -0,0 +1,40 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/shiraily/gcal-sync/calendar"
+	"github.com/shiraily/gcal-sync/logging"
+)
+
+// OnStatus responds status of all tenants, or only the one given by tenant parameter, as JSON
+func OnStatus(w http.ResponseWriter, r *http.Request) {
+	tenantIds := []string{r.URL.Query().Get("tenant")}
+	if tenantIds[0] == "" {
+		tenantIds = tenantIdsOf(pool.Config())
+	}
+	statuses := []*calendar.Status{}
+	for _, id := range tenantIds {
+		cli, err := pool.Client(id)
+		if err != nil {
+			logging.Warn("status", "error", err)
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		st, err := cli.WithContext(r.Context()).Status()
+		if err != nil {
+			logging.Error("status", "tenant", id, "error", err)
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		if n, ok := jobs.Retrying(id); ok {
+			st.RetryingJobs = &n
+		}
+		statuses = append(statuses, st)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(map[string]interface{}{"tenants": statuses}); err != nil {
+		logging.Error("status", "error", err)
+	}
+}
@@ -0,0 +1,93 @@
+package store
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+const defaultFilePath = "state.json"
+
+// fileStore keeps state in a local JSON file for self-hosting without GCP.
+// State is read only at opening and kept in memory, so the file is used by a single process.
+// Another process opening the same file fails while it is held.
+type fileStore struct {
+	*memoryStore
+	path   string
+	unlock func() error
+}
+
+func NewFileStore(path string) (StateStore, error) {
+	if path == "" {
+		path = defaultFilePath
+	}
+	unlock, err := lockFile(path + ".lock")
+	if err != nil {
+		return nil, fmt.Errorf("lock state file: %s", err)
+	}
+	s, err := openFileStore(path)
+	if err != nil {
+		unlock()
+		return nil, err
+	}
+	s.unlock = unlock
+	return s, nil
+}
+
+func openFileStore(path string) (*fileStore, error) {
+	s := &fileStore{memoryStore: newMemoryStore(), path: path}
+	b, err := ioutil.ReadFile(path)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return nil, fmt.Errorf("read state file: %s", err)
+	}
+	if len(b) > 0 {
+		if err := json.Unmarshal(b, &s.tenants); err != nil {
+			return nil, fmt.Errorf("parse state file: %s", err)
+		}
+		// files written before channels became a list have single "channel"
+		var legacy map[string]struct {
+			Channel *Channel `json:"channel"`
+		}
+		if err := json.Unmarshal(b, &legacy); err == nil {
+			for id, t := range legacy {
+				if t.Channel != nil && len(s.tenants[id].Channels) == 0 {
+					s.tenants[id].Channels = []Channel{*t.Channel}
+				}
+			}
+		}
+	}
+	s.memoryStore.persist = s.write
+	return s, nil
+}
+
+// Close lets another process open the file
+func (s *fileStore) Close() error {
+	return s.unlock()
+}
+
+// write replaces the file atomically not to break state when the process dies while writing
+func (s *fileStore) write() error {
+	b, err := json.MarshalIndent(s.tenants, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp, err := ioutil.TempFile(filepath.Dir(s.path), filepath.Base(s.path)+".*")
+	if err != nil {
+		return fmt.Errorf("write state file: %s", err)
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(b); err != nil {
+		tmp.Close()
+		return fmt.Errorf("write state file: %s", err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("write state file: %s", err)
+	}
+	if err := os.Rename(tmp.Name(), s.path); err != nil {
+		return fmt.Errorf("write state file: %s", err)
+	}
+	return nil
+}
@@ -0,0 +1,460 @@
+package store
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"time"
+
+	"cloud.google.com/go/firestore"
+	firebase "firebase.google.com/go"
+	"google.golang.org/api/iterator"
+	"google.golang.org/api/option"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"github.com/shiraily/gcal-sync/config"
+)
+
+type firestoreStore struct {
+	cli *firestore.Client
+}
+
+func NewFirestoreStore(ctx context.Context, project string, credentialFile string) (StateStore, error) {
+	app, err := firebase.NewApp(ctx, &firebase.Config{ProjectID: project}, option.WithCredentialsFile(credentialFile))
+	if err != nil {
+		return nil, err
+	}
+	cli, err := app.Firestore(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return &firestoreStore{cli: cli}, nil
+}
+
+func (s *firestoreStore) Close() error {
+	return s.cli.Close()
+}
+
+// doc is the document keeping sync token and channel of the tenant.
+// The default tenant keeps the original location for compatibility.
+func (s *firestoreStore) doc(tenantId string) *firestore.DocumentRef {
+	if tenantId == config.DefaultTenantId {
+		return s.cli.Collection("calendar").Doc("channel")
+	}
+	return s.cli.Collection("tenants").Doc(tenantId)
+}
+
+// get returns nil data if the document does not exist yet
+func (s *firestoreStore) get(ctx context.Context, tenantId string) (map[string]interface{}, error) {
+	snap, err := s.doc(tenantId).Get(ctx)
+	if status.Code(err) == codes.NotFound {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	return snap.Data(), nil
+}
+
+func (s *firestoreStore) ReadToken(ctx context.Context, tenantId string) (string, error) {
+	m, err := s.get(ctx, tenantId)
+	if err != nil {
+		return "", fmt.Errorf("sync token: %w", err)
+	}
+	token, _ := m["nextSyncToken"].(string)
+	return token, nil
+}
+
+func (s *firestoreStore) SaveToken(ctx context.Context, tenantId string, token string) error {
+	_, err := s.doc(tenantId).Set(ctx, map[string]interface{}{"nextSyncToken": token}, firestore.MergeAll)
+	if err != nil {
+		return fmt.Errorf("sync token: %w", err)
+	}
+	return nil
+}
+
+func (s *firestoreStore) CompareAndSwapToken(ctx context.Context, tenantId string, old string, token string) error {
+	doc := s.doc(tenantId)
+	err := s.cli.RunTransaction(ctx, func(ctx context.Context, tx *firestore.Transaction) error {
+		var current string
+		snap, err := tx.Get(doc)
+		if err == nil {
+			current, _ = snap.Data()["nextSyncToken"].(string)
+		} else if status.Code(err) != codes.NotFound {
+			return err
+		}
+		if current != old {
+			return ErrTokenConflict
+		}
+		return tx.Set(doc, map[string]interface{}{"nextSyncToken": token}, firestore.MergeAll)
+	})
+	if errors.Is(err, ErrTokenConflict) {
+		return err
+	} else if err != nil {
+		return fmt.Errorf("sync token: %w", err)
+	}
+	return nil
+}
+
+func (s *firestoreStore) AcquireLock(ctx context.Context, name string, owner string, ttl time.Duration) (bool, error) {
+	doc := s.cli.Collection("locks").Doc(name)
+	acquired := false
+	err := s.cli.RunTransaction(ctx, func(ctx context.Context, tx *firestore.Transaction) error {
+		acquired = false
+		now := time.Now()
+		snap, err := tx.Get(doc)
+		if err == nil {
+			m := snap.Data()
+			holder, _ := m["owner"].(string)
+			expires, _ := m["expires"].(time.Time)
+			if holder != owner && now.Before(expires) {
+				return nil
+			}
+		} else if status.Code(err) != codes.NotFound {
+			return err
+		}
+		acquired = true
+		return tx.Set(doc, map[string]interface{}{"owner": owner, "expires": now.Add(ttl)})
+	})
+	if err != nil {
+		return false, fmt.Errorf("lock %s: %s", name, err)
+	}
+	return acquired, nil
+}
+
+func (s *firestoreStore) ReleaseLock(ctx context.Context, name string, owner string) error {
+	doc := s.cli.Collection("locks").Doc(name)
+	err := s.cli.RunTransaction(ctx, func(ctx context.Context, tx *firestore.Transaction) error {
+		snap, err := tx.Get(doc)
+		if status.Code(err) == codes.NotFound {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		if holder, _ := snap.Data()["owner"].(string); holder != owner {
+			return nil
+		}
+		return tx.Delete(doc)
+	})
+	if err != nil {
+		return fmt.Errorf("lock %s: %s", name, err)
+	}
+	return nil
+}
+
+// ListChannels also returns the channel saved in the tenant document before channels became a list
+func (s *firestoreStore) ListChannels(ctx context.Context, tenantId string) ([]Channel, error) {
+	var channels []Channel
+	m, err := s.get(ctx, tenantId)
+	if err != nil {
+		return nil, fmt.Errorf("channels: %w", err)
+	}
+	if id, _ := m["channelId"].(string); id != "" {
+		ch := Channel{Id: id}
+		ch.ResourceId, _ = m["resourceId"].(string)
+		ch.Expiration, _ = m["exp"].(int64)
+		ch.Token, _ = m["token"].(string)
+		// it was the active channel
+		ch.Confirmed = true
+		channels = append(channels, ch)
+	}
+
+	iter := s.doc(tenantId).Collection("channels").Documents(ctx)
+	defer iter.Stop()
+	for {
+		snap, err := iter.Next()
+		if err == iterator.Done {
+			break
+		} else if err != nil {
+			return nil, fmt.Errorf("channels: %w", err)
+		}
+		var ch Channel
+		if err := snap.DataTo(&ch); err != nil {
+			return nil, fmt.Errorf("channels: %w", err)
+		}
+		if len(channels) > 0 && channels[0].Id == ch.Id {
+			// legacy channel updated after migration
+			channels[0] = ch
+			continue
+		}
+		channels = append(channels, ch)
+	}
+	return channels, nil
+}
+
+func (s *firestoreStore) SaveChannel(ctx context.Context, tenantId string, ch Channel) error {
+	if _, err := s.doc(tenantId).Collection("channels").Doc(ch.Id).Set(ctx, ch); err != nil {
+		return fmt.Errorf("channel: %w", err)
+	}
+	return nil
+}
+
+func (s *firestoreStore) SetChannelWatch(ctx context.Context, tenantId string, channelId string, resourceId string, expiration int64) error {
+	return s.updateChannel(ctx, tenantId, channelId, []firestore.Update{
+		{Path: "ResourceId", Value: resourceId},
+		{Path: "Expiration", Value: expiration},
+	})
+}
+
+func (s *firestoreStore) ConfirmChannel(ctx context.Context, tenantId string, channelId string) error {
+	err := s.updateChannel(ctx, tenantId, channelId, []firestore.Update{{Path: "Confirmed", Value: true}})
+	if !errors.Is(err, ErrUnknownChannel) {
+		return err
+	}
+	// channel saved in the tenant document before channels became a list is already confirmed
+	m, err := s.get(ctx, tenantId)
+	if err != nil {
+		return fmt.Errorf("channel: %w", err)
+	}
+	if id, _ := m["channelId"].(string); id == channelId {
+		return nil
+	}
+	return ErrUnknownChannel
+}
+
+// updateChannel updates only the fields, which fails if the channel does not exist
+func (s *firestoreStore) updateChannel(ctx context.Context, tenantId string, channelId string, updates []firestore.Update) error {
+	_, err := s.doc(tenantId).Collection("channels").Doc(channelId).Update(ctx, updates)
+	if status.Code(err) == codes.NotFound {
+		return ErrUnknownChannel
+	} else if err != nil {
+		return fmt.Errorf("channel: %w", err)
+	}
+	return nil
+}
+
+func (s *firestoreStore) DeleteChannel(ctx context.Context, tenantId string, channelId string) error {
+	if _, err := s.doc(tenantId).Collection("channels").Doc(channelId).Delete(ctx); err != nil {
+		return fmt.Errorf("channel: %w", err)
+	}
+	m, err := s.get(ctx, tenantId)
+	if err != nil {
+		return fmt.Errorf("channel: %w", err)
+	}
+	if id, _ := m["channelId"].(string); id == channelId {
+		_, err := s.doc(tenantId).Update(ctx, []firestore.Update{
+			{Path: "channelId", Value: firestore.Delete},
+			{Path: "resourceId", Value: firestore.Delete},
+			{Path: "exp", Value: firestore.Delete},
+			{Path: "token", Value: firestore.Delete},
+		})
+		if err != nil {
+			return fmt.Errorf("channel: %w", err)
+		}
+	}
+	return nil
+}
+
+func (s *firestoreStore) ReadMapping(ctx context.Context, tenantId string, srcEventId string) (*Mapping, error) {
+	snap, err := s.doc(tenantId).Collection("mappings").Doc(srcEventId).Get(ctx)
+	if status.Code(err) == codes.NotFound {
+		return nil, nil
+	} else if err != nil {
+		return nil, fmt.Errorf("mapping: %w", err)
+	}
+	var m Mapping
+	if err := snap.DataTo(&m); err != nil {
+		return nil, fmt.Errorf("mapping: %w", err)
+	}
+	return &m, nil
+}
+
+func (s *firestoreStore) SaveMapping(ctx context.Context, tenantId string, m Mapping) error {
+	if _, err := s.doc(tenantId).Collection("mappings").Doc(m.SrcEventId).Set(ctx, m); err != nil {
+		return fmt.Errorf("mapping: %w", err)
+	}
+	return nil
+}
+
+func (s *firestoreStore) DeleteMapping(ctx context.Context, tenantId string, srcEventId string) error {
+	if _, err := s.doc(tenantId).Collection("mappings").Doc(srcEventId).Delete(ctx); err != nil {
+		return fmt.Errorf("mapping: %w", err)
+	}
+	return nil
+}
+
+func (s *firestoreStore) ListMappings(ctx context.Context, tenantId string) ([]Mapping, error) {
+	iter := s.doc(tenantId).Collection("mappings").Documents(ctx)
+	defer iter.Stop()
+	var mappings []Mapping
+	for {
+		snap, err := iter.Next()
+		if err == iterator.Done {
+			break
+		} else if err != nil {
+			return nil, fmt.Errorf("mappings: %w", err)
+		}
+		var m Mapping
+		if err := snap.DataTo(&m); err != nil {
+			return nil, fmt.Errorf("mappings: %w", err)
+		}
+		mappings = append(mappings, m)
+	}
+	return mappings, nil
+}
+
+// DeleteMappingsBefore queries by Created, since mappings without end are saved with zero End
+// and blocks end after they are created
+func (s *firestoreStore) DeleteMappingsBefore(ctx context.Context, tenantId string, t time.Time) (int, error) {
+	iter := s.doc(tenantId).Collection("mappings").Where("Created", "<", t).Documents(ctx)
+	defer iter.Stop()
+	deleted := 0
+	for {
+		snap, err := iter.Next()
+		if err == iterator.Done {
+			break
+		} else if err != nil {
+			return deleted, fmt.Errorf("mappings: %w", err)
+		}
+		var m Mapping
+		if err := snap.DataTo(&m); err != nil {
+			return deleted, fmt.Errorf("mappings: %w", err)
+		}
+		if !m.expired(t) {
+			continue
+		}
+		if _, err := snap.Ref.Delete(ctx); err != nil {
+			return deleted, fmt.Errorf("mappings: %w", err)
+		}
+		deleted++
+	}
+	return deleted, nil
+}
+
+func (s *firestoreStore) SaveRun(ctx context.Context, tenantId string, r Run) error {
+	if _, err := s.doc(tenantId).Collection("runs").Doc(r.Id).Set(ctx, r); err != nil {
+		return fmt.Errorf("run: %w", err)
+	}
+	return nil
+}
+
+func (s *firestoreStore) ReadRun(ctx context.Context, tenantId string, runId string) (*Run, error) {
+	snap, err := s.doc(tenantId).Collection("runs").Doc(runId).Get(ctx)
+	if status.Code(err) == codes.NotFound {
+		return nil, nil
+	} else if err != nil {
+		return nil, fmt.Errorf("run: %w", err)
+	}
+	var r Run
+	if err := snap.DataTo(&r); err != nil {
+		return nil, fmt.Errorf("run: %w", err)
+	}
+	return &r, nil
+}
+
+func (s *firestoreStore) ListRuns(ctx context.Context, tenantId string, limit int) ([]Run, error) {
+	q := s.doc(tenantId).Collection("runs").OrderBy("Started", firestore.Desc)
+	if limit > 0 {
+		q = q.Limit(limit)
+	}
+	iter := q.Documents(ctx)
+	defer iter.Stop()
+	var runs []Run
+	for {
+		snap, err := iter.Next()
+		if err == iterator.Done {
+			break
+		} else if err != nil {
+			return nil, fmt.Errorf("runs: %w", err)
+		}
+		var r Run
+		if err := snap.DataTo(&r); err != nil {
+			return nil, fmt.Errorf("runs: %w", err)
+		}
+		runs = append(runs, r)
+	}
+	return runs, nil
+}
+
+func (s *firestoreStore) DeleteRunsBefore(ctx context.Context, tenantId string, t time.Time) (int, error) {
+	iter := s.doc(tenantId).Collection("runs").Where("Started", "<", t).Documents(ctx)
+	defer iter.Stop()
+	deleted := 0
+	for {
+		snap, err := iter.Next()
+		if err == iterator.Done {
+			break
+		} else if err != nil {
+			return deleted, fmt.Errorf("runs: %w", err)
+		}
+		if _, err := snap.Ref.Delete(ctx); err != nil {
+			return deleted, fmt.Errorf("runs: %w", err)
+		}
+		deleted++
+	}
+	audit := s.doc(tenantId).Collection("audit").Where("Time", "<", t).Documents(ctx)
+	defer audit.Stop()
+	for {
+		snap, err := audit.Next()
+		if err == iterator.Done {
+			break
+		} else if err != nil {
+			return deleted, fmt.Errorf("audit: %w", err)
+		}
+		if _, err := snap.Ref.Delete(ctx); err != nil {
+			return deleted, fmt.Errorf("audit: %w", err)
+		}
+	}
+	return deleted, nil
+}
+
+func (s *firestoreStore) SaveAudit(ctx context.Context, tenantId string, entries []AuditEntry) error {
+	col := s.doc(tenantId).Collection("audit")
+	// batch is limited to 500 writes
+	for i := 0; i < len(entries); i += 500 {
+		end := i + 500
+		if end > len(entries) {
+			end = len(entries)
+		}
+		batch := s.cli.Batch()
+		for _, e := range entries[i:end] {
+			batch.Set(col.Doc(e.Id), e)
+		}
+		if _, err := batch.Commit(ctx); err != nil {
+			return fmt.Errorf("audit: %w", err)
+		}
+	}
+	return nil
+}
+
+// ListAudit filters by one field and sorts in memory, not to require composite indexes
+func (s *firestoreStore) ListAudit(ctx context.Context, tenantId string, q AuditQuery) ([]AuditEntry, error) {
+	query := s.doc(tenantId).Collection("audit").Query
+	switch {
+	case q.SrcEventId != "":
+		query = query.Where("SrcEventId", "==", q.SrcEventId)
+	case q.DestEventId != "":
+		query = query.Where("DestEventId", "==", q.DestEventId)
+	case q.RunId != "":
+		query = query.Where("RunId", "==", q.RunId)
+	default:
+		query = query.OrderBy("Time", firestore.Desc)
+		if q.Limit > 0 {
+			query = query.Limit(q.Limit)
+		}
+	}
+	iter := query.Documents(ctx)
+	defer iter.Stop()
+	var entries []AuditEntry
+	for {
+		snap, err := iter.Next()
+		if err == iterator.Done {
+			break
+		} else if err != nil {
+			return nil, fmt.Errorf("audit: %w", err)
+		}
+		var e AuditEntry
+		if err := snap.DataTo(&e); err != nil {
+			return nil, fmt.Errorf("audit: %w", err)
+		}
+		if q.match(e) {
+			entries = append(entries, e)
+		}
+	}
+	sort.SliceStable(entries, func(i, j int) bool { return entries[i].Time.After(entries[j].Time) })
+	if q.Limit > 0 && len(entries) > q.Limit {
+		entries = entries[:q.Limit]
+	}
+	return entries, nil
+}
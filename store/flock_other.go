@@ -0,0 +1,9 @@
+//go:build !darwin && !dragonfly && !freebsd && !linux && !netbsd && !openbsd
+// +build !darwin,!dragonfly,!freebsd,!linux,!netbsd,!openbsd
+
+package store
+
+// lockFile does nothing where flock is unavailable, so only one process must use the file
+func lockFile(path string) (func() error, error) {
+	return func() error { return nil }, nil
+}
@@ -0,0 +1,297 @@
+package store
+
+import (
+	"context"
+	"sort"
+	"sync"
+	"time"
+)
+
+type tenantState struct {
+	Token    string             `json:"nextSyncToken,omitempty"`
+	Channels []Channel          `json:"channels,omitempty"`
+	Mappings map[string]Mapping `json:"mappings,omitempty"`
+	Runs     []Run              `json:"runs,omitempty"`
+	Audit    []AuditEntry       `json:"audit,omitempty"`
+}
+
+type lock struct {
+	Owner   string    `json:"owner"`
+	Expires time.Time `json:"expires"`
+}
+
+// memoryStore keeps state in process. It is for tests and also the base of fileStore.
+type memoryStore struct {
+	mu      sync.Mutex
+	tenants map[string]*tenantState
+	locks   map[string]lock
+	// persist is called with the lock held after every change
+	persist func() error
+}
+
+func NewMemoryStore() StateStore {
+	return newMemoryStore()
+}
+
+func newMemoryStore() *memoryStore {
+	return &memoryStore{
+		tenants: map[string]*tenantState{},
+		locks:   map[string]lock{},
+		persist: func() error { return nil },
+	}
+}
+
+func (s *memoryStore) Close() error {
+	return nil
+}
+
+func (s *memoryStore) tenant(tenantId string) *tenantState {
+	t, ok := s.tenants[tenantId]
+	if !ok {
+		t = &tenantState{}
+		s.tenants[tenantId] = t
+	}
+	if t.Mappings == nil {
+		t.Mappings = map[string]Mapping{}
+	}
+	return t
+}
+
+func (s *memoryStore) ReadToken(ctx context.Context, tenantId string) (string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.tenant(tenantId).Token, nil
+}
+
+func (s *memoryStore) SaveToken(ctx context.Context, tenantId string, token string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.tenant(tenantId).Token = token
+	return s.persist()
+}
+
+func (s *memoryStore) CompareAndSwapToken(ctx context.Context, tenantId string, old string, token string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	t := s.tenant(tenantId)
+	if t.Token != old {
+		return ErrTokenConflict
+	}
+	t.Token = token
+	return s.persist()
+}
+
+func (s *memoryStore) AcquireLock(ctx context.Context, name string, owner string, ttl time.Duration) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := time.Now()
+	if l, ok := s.locks[name]; ok && l.Owner != owner && now.Before(l.Expires) {
+		return false, nil
+	}
+	s.locks[name] = lock{Owner: owner, Expires: now.Add(ttl)}
+	return true, nil
+}
+
+func (s *memoryStore) ReleaseLock(ctx context.Context, name string, owner string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if l, ok := s.locks[name]; ok && l.Owner == owner {
+		delete(s.locks, name)
+	}
+	return nil
+}
+
+func (s *memoryStore) ListChannels(ctx context.Context, tenantId string) ([]Channel, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]Channel{}, s.tenant(tenantId).Channels...), nil
+}
+
+func (s *memoryStore) SaveChannel(ctx context.Context, tenantId string, ch Channel) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	t := s.tenant(tenantId)
+	for i := range t.Channels {
+		if t.Channels[i].Id == ch.Id {
+			t.Channels[i] = ch
+			return s.persist()
+		}
+	}
+	t.Channels = append(t.Channels, ch)
+	return s.persist()
+}
+
+func (s *memoryStore) SetChannelWatch(ctx context.Context, tenantId string, channelId string, resourceId string, expiration int64) error {
+	return s.updateChannel(tenantId, channelId, func(ch *Channel) {
+		ch.ResourceId, ch.Expiration = resourceId, expiration
+	})
+}
+
+func (s *memoryStore) ConfirmChannel(ctx context.Context, tenantId string, channelId string) error {
+	return s.updateChannel(tenantId, channelId, func(ch *Channel) {
+		ch.Confirmed = true
+	})
+}
+
+func (s *memoryStore) updateChannel(tenantId string, channelId string, f func(ch *Channel)) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	t := s.tenant(tenantId)
+	for i := range t.Channels {
+		if t.Channels[i].Id == channelId {
+			f(&t.Channels[i])
+			return s.persist()
+		}
+	}
+	return ErrUnknownChannel
+}
+
+func (s *memoryStore) DeleteChannel(ctx context.Context, tenantId string, channelId string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	t := s.tenant(tenantId)
+	for i := range t.Channels {
+		if t.Channels[i].Id == channelId {
+			t.Channels = append(t.Channels[:i], t.Channels[i+1:]...)
+			break
+		}
+	}
+	return s.persist()
+}
+
+func (s *memoryStore) ReadMapping(ctx context.Context, tenantId string, srcEventId string) (*Mapping, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	m, ok := s.tenant(tenantId).Mappings[srcEventId]
+	if !ok {
+		return nil, nil
+	}
+	return &m, nil
+}
+
+func (s *memoryStore) SaveMapping(ctx context.Context, tenantId string, m Mapping) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.tenant(tenantId).Mappings[m.SrcEventId] = m
+	return s.persist()
+}
+
+func (s *memoryStore) DeleteMapping(ctx context.Context, tenantId string, srcEventId string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.tenant(tenantId).Mappings, srcEventId)
+	return s.persist()
+}
+
+func (s *memoryStore) ListMappings(ctx context.Context, tenantId string) ([]Mapping, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var mappings []Mapping
+	for _, m := range s.tenant(tenantId).Mappings {
+		mappings = append(mappings, m)
+	}
+	sort.Slice(mappings, func(i, j int) bool { return mappings[i].Created.Before(mappings[j].Created) })
+	return mappings, nil
+}
+
+func (s *memoryStore) DeleteMappingsBefore(ctx context.Context, tenantId string, t time.Time) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	tenant := s.tenant(tenantId)
+	deleted := 0
+	for id, m := range tenant.Mappings {
+		if m.expired(t) {
+			delete(tenant.Mappings, id)
+			deleted++
+		}
+	}
+	if deleted == 0 {
+		return 0, nil
+	}
+	return deleted, s.persist()
+}
+
+func (s *memoryStore) SaveRun(ctx context.Context, tenantId string, r Run) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	t := s.tenant(tenantId)
+	for i := range t.Runs {
+		if t.Runs[i].Id == r.Id {
+			t.Runs[i] = r
+			return s.persist()
+		}
+	}
+	t.Runs = append(t.Runs, r)
+	return s.persist()
+}
+
+func (s *memoryStore) ReadRun(ctx context.Context, tenantId string, runId string) (*Run, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, r := range s.tenant(tenantId).Runs {
+		if r.Id == runId {
+			return &r, nil
+		}
+	}
+	return nil, nil
+}
+
+func (s *memoryStore) ListRuns(ctx context.Context, tenantId string, limit int) ([]Run, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	runs := append([]Run{}, s.tenant(tenantId).Runs...)
+	sort.Slice(runs, func(i, j int) bool { return runs[i].Started.After(runs[j].Started) })
+	if limit > 0 && len(runs) > limit {
+		runs = runs[:limit]
+	}
+	return runs, nil
+}
+
+func (s *memoryStore) DeleteRunsBefore(ctx context.Context, tenantId string, t time.Time) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	tenant := s.tenant(tenantId)
+	var kept []Run
+	for _, r := range tenant.Runs {
+		if !r.Started.Before(t) {
+			kept = append(kept, r)
+		}
+	}
+	deleted := len(tenant.Runs) - len(kept)
+	tenant.Runs = kept
+	var audit []AuditEntry
+	for _, e := range tenant.Audit {
+		if !e.Time.Before(t) {
+			audit = append(audit, e)
+		}
+	}
+	tenant.Audit = audit
+	return deleted, s.persist()
+}
+
+func (s *memoryStore) SaveAudit(ctx context.Context, tenantId string, entries []AuditEntry) error {
+	if len(entries) == 0 {
+		return nil
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	t := s.tenant(tenantId)
+	t.Audit = append(t.Audit, entries...)
+	return s.persist()
+}
+
+func (s *memoryStore) ListAudit(ctx context.Context, tenantId string, q AuditQuery) ([]AuditEntry, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var entries []AuditEntry
+	for _, e := range s.tenant(tenantId).Audit {
+		if q.match(e) {
+			entries = append(entries, e)
+		}
+	}
+	sort.SliceStable(entries, func(i, j int) bool { return entries[i].Time.After(entries[j].Time) })
+	if q.Limit > 0 && len(entries) > q.Limit {
+		entries = entries[:q.Limit]
+	}
+	return entries, nil
+}
@@ -0,0 +1,181 @@
+package store
+
+import (
+	"context"
+	"time"
+
+	"github.com/shiraily/gcal-sync/retry"
+	"github.com/shiraily/gcal-sync/tracing"
+)
+
+// retryStore retries calls failed by unavailable backend, and traces each call as span.
+// Token swap and locks are not retried, since they run in transactions already retried by
+// the client, and retrying after a lost response would look like a conflict.
+type retryStore struct {
+	StateStore
+	policy *retry.Policy
+	// name prefixes spans, such as firestore
+	name string
+}
+
+func withRetry(s StateStore, name string, policy *retry.Policy) StateStore {
+	return &retryStore{StateStore: s, name: name, policy: policy}
+}
+
+// do runs f in span, retrying it if retried is set
+func (s *retryStore) do(ctx context.Context, op string, retried bool, f func(ctx context.Context) error) (err error) {
+	ctx, span := tracing.Start(ctx, s.name+"."+op)
+	defer func() { tracing.End(span, err) }()
+	if !retried {
+		return f(ctx)
+	}
+	return s.policy.Do(ctx, func() error {
+		return f(ctx)
+	})
+}
+
+func (s *retryStore) CompareAndSwapToken(ctx context.Context, tenantId string, old string, token string) error {
+	return s.do(ctx, "CompareAndSwapToken", false, func(ctx context.Context) error {
+		return s.StateStore.CompareAndSwapToken(ctx, tenantId, old, token)
+	})
+}
+
+func (s *retryStore) AcquireLock(ctx context.Context, name string, owner string, ttl time.Duration) (ok bool, err error) {
+	err = s.do(ctx, "AcquireLock", false, func(ctx context.Context) error {
+		ok, err = s.StateStore.AcquireLock(ctx, name, owner, ttl)
+		return err
+	})
+	return ok, err
+}
+
+func (s *retryStore) ReleaseLock(ctx context.Context, name string, owner string) error {
+	return s.do(ctx, "ReleaseLock", false, func(ctx context.Context) error {
+		return s.StateStore.ReleaseLock(ctx, name, owner)
+	})
+}
+
+func (s *retryStore) ReadToken(ctx context.Context, tenantId string) (token string, err error) {
+	err = s.do(ctx, "ReadToken", true, func(ctx context.Context) error {
+		token, err = s.StateStore.ReadToken(ctx, tenantId)
+		return err
+	})
+	return token, err
+}
+
+func (s *retryStore) SaveToken(ctx context.Context, tenantId string, token string) error {
+	return s.do(ctx, "SaveToken", true, func(ctx context.Context) error {
+		return s.StateStore.SaveToken(ctx, tenantId, token)
+	})
+}
+
+func (s *retryStore) ListChannels(ctx context.Context, tenantId string) (channels []Channel, err error) {
+	err = s.do(ctx, "ListChannels", true, func(ctx context.Context) error {
+		channels, err = s.StateStore.ListChannels(ctx, tenantId)
+		return err
+	})
+	return channels, err
+}
+
+func (s *retryStore) SaveChannel(ctx context.Context, tenantId string, ch Channel) error {
+	return s.do(ctx, "SaveChannel", true, func(ctx context.Context) error {
+		return s.StateStore.SaveChannel(ctx, tenantId, ch)
+	})
+}
+
+func (s *retryStore) SetChannelWatch(ctx context.Context, tenantId string, channelId string, resourceId string, expiration int64) error {
+	return s.do(ctx, "SetChannelWatch", true, func(ctx context.Context) error {
+		return s.StateStore.SetChannelWatch(ctx, tenantId, channelId, resourceId, expiration)
+	})
+}
+
+func (s *retryStore) ConfirmChannel(ctx context.Context, tenantId string, channelId string) error {
+	return s.do(ctx, "ConfirmChannel", true, func(ctx context.Context) error {
+		return s.StateStore.ConfirmChannel(ctx, tenantId, channelId)
+	})
+}
+
+func (s *retryStore) DeleteChannel(ctx context.Context, tenantId string, channelId string) error {
+	return s.do(ctx, "DeleteChannel", true, func(ctx context.Context) error {
+		return s.StateStore.DeleteChannel(ctx, tenantId, channelId)
+	})
+}
+
+func (s *retryStore) ReadMapping(ctx context.Context, tenantId string, srcEventId string) (m *Mapping, err error) {
+	err = s.do(ctx, "ReadMapping", true, func(ctx context.Context) error {
+		m, err = s.StateStore.ReadMapping(ctx, tenantId, srcEventId)
+		return err
+	})
+	return m, err
+}
+
+func (s *retryStore) SaveMapping(ctx context.Context, tenantId string, m Mapping) error {
+	return s.do(ctx, "SaveMapping", true, func(ctx context.Context) error {
+		return s.StateStore.SaveMapping(ctx, tenantId, m)
+	})
+}
+
+func (s *retryStore) DeleteMapping(ctx context.Context, tenantId string, srcEventId string) error {
+	return s.do(ctx, "DeleteMapping", true, func(ctx context.Context) error {
+		return s.StateStore.DeleteMapping(ctx, tenantId, srcEventId)
+	})
+}
+
+func (s *retryStore) ListMappings(ctx context.Context, tenantId string) (mappings []Mapping, err error) {
+	err = s.do(ctx, "ListMappings", true, func(ctx context.Context) error {
+		mappings, err = s.StateStore.ListMappings(ctx, tenantId)
+		return err
+	})
+	return mappings, err
+}
+
+func (s *retryStore) DeleteMappingsBefore(ctx context.Context, tenantId string, t time.Time) (n int, err error) {
+	err = s.do(ctx, "DeleteMappingsBefore", true, func(ctx context.Context) error {
+		n, err = s.StateStore.DeleteMappingsBefore(ctx, tenantId, t)
+		return err
+	})
+	return n, err
+}
+
+func (s *retryStore) SaveRun(ctx context.Context, tenantId string, r Run) error {
+	return s.do(ctx, "SaveRun", true, func(ctx context.Context) error {
+		return s.StateStore.SaveRun(ctx, tenantId, r)
+	})
+}
+
+func (s *retryStore) ReadRun(ctx context.Context, tenantId string, runId string) (r *Run, err error) {
+	err = s.do(ctx, "ReadRun", true, func(ctx context.Context) error {
+		r, err = s.StateStore.ReadRun(ctx, tenantId, runId)
+		return err
+	})
+	return r, err
+}
+
+func (s *retryStore) ListRuns(ctx context.Context, tenantId string, limit int) (runs []Run, err error) {
+	err = s.do(ctx, "ListRuns", true, func(ctx context.Context) error {
+		runs, err = s.StateStore.ListRuns(ctx, tenantId, limit)
+		return err
+	})
+	return runs, err
+}
+
+func (s *retryStore) DeleteRunsBefore(ctx context.Context, tenantId string, t time.Time) (n int, err error) {
+	err = s.do(ctx, "DeleteRunsBefore", true, func(ctx context.Context) error {
+		n, err = s.StateStore.DeleteRunsBefore(ctx, tenantId, t)
+		return err
+	})
+	return n, err
+}
+
+func (s *retryStore) SaveAudit(ctx context.Context, tenantId string, entries []AuditEntry) error {
+	return s.do(ctx, "SaveAudit", true, func(ctx context.Context) error {
+		return s.StateStore.SaveAudit(ctx, tenantId, entries)
+	})
+}
+
+func (s *retryStore) ListAudit(ctx context.Context, tenantId string, q AuditQuery) (entries []AuditEntry, err error) {
+	err = s.do(ctx, "ListAudit", true, func(ctx context.Context) error {
+		entries, err = s.StateStore.ListAudit(ctx, tenantId, q)
+		return err
+	})
+	return entries, err
+}
@@ -0,0 +1,530 @@
+package store
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	_ "github.com/mattn/go-sqlite3"
+)
+
+const defaultSQLitePath = "state.db"
+
+// migrations are applied in order and never modified once released.
+// Add a new one to change schema.
+var migrations = []string{
+	`CREATE TABLE tokens (
+		tenant TEXT PRIMARY KEY,
+		token  TEXT NOT NULL
+	);
+	CREATE TABLE channels (
+		tenant      TEXT PRIMARY KEY,
+		channel_id  TEXT NOT NULL,
+		resource_id TEXT NOT NULL,
+		expiration  INTEGER NOT NULL
+	);
+	CREATE TABLE mappings (
+		tenant        TEXT NOT NULL,
+		src_event_id  TEXT NOT NULL,
+		dest_event_id TEXT NOT NULL,
+		created       INTEGER NOT NULL,
+		PRIMARY KEY (tenant, src_event_id)
+	);
+	CREATE TABLE runs (
+		tenant   TEXT NOT NULL,
+		id       TEXT NOT NULL,
+		started  INTEGER NOT NULL,
+		finished INTEGER NOT NULL,
+		created  INTEGER NOT NULL,
+		error    TEXT NOT NULL DEFAULT '',
+		PRIMARY KEY (tenant, id)
+	);
+	CREATE INDEX runs_started ON runs (tenant, started);`,
+	`CREATE TABLE locks (
+		name    TEXT PRIMARY KEY,
+		owner   TEXT NOT NULL,
+		expires INTEGER NOT NULL
+	);`,
+	`ALTER TABLE channels ADD COLUMN token TEXT NOT NULL DEFAULT '';`,
+	`CREATE TABLE watch_channels (
+		tenant      TEXT NOT NULL,
+		channel_id  TEXT NOT NULL,
+		resource_id TEXT NOT NULL,
+		expiration  INTEGER NOT NULL,
+		token       TEXT NOT NULL,
+		confirmed   INTEGER NOT NULL DEFAULT 0,
+		created     INTEGER NOT NULL DEFAULT 0,
+		PRIMARY KEY (tenant, channel_id)
+	);
+	INSERT INTO watch_channels (tenant, channel_id, resource_id, expiration, token, confirmed)
+		SELECT tenant, channel_id, resource_id, expiration, token, 1 FROM channels;
+	DROP TABLE channels;`,
+	`ALTER TABLE runs ADD COLUMN failures TEXT NOT NULL DEFAULT '[]';`,
+	`ALTER TABLE runs ADD COLUMN triggered_by TEXT NOT NULL DEFAULT '';
+	ALTER TABLE runs ADD COLUMN token_before TEXT NOT NULL DEFAULT '';
+	ALTER TABLE runs ADD COLUMN token_after TEXT NOT NULL DEFAULT '';
+	ALTER TABLE runs ADD COLUMN seen INTEGER NOT NULL DEFAULT 0;
+	CREATE TABLE audit (
+		tenant        TEXT NOT NULL,
+		id            TEXT NOT NULL,
+		run_id        TEXT NOT NULL,
+		time          INTEGER NOT NULL,
+		action        TEXT NOT NULL,
+		src_event_id  TEXT NOT NULL,
+		dest_event_id TEXT NOT NULL,
+		rule          TEXT NOT NULL,
+		reason        TEXT NOT NULL,
+		PRIMARY KEY (tenant, id)
+	);
+	CREATE INDEX audit_src ON audit (tenant, src_event_id, time);
+	CREATE INDEX audit_dest ON audit (tenant, dest_event_id, time);
+	CREATE INDEX audit_time ON audit (tenant, time);`,
+	`ALTER TABLE mappings ADD COLUMN end_time INTEGER NOT NULL DEFAULT 0;`,
+}
+
+type sqliteStore struct {
+	db *sql.DB
+}
+
+func NewSQLiteStore(ctx context.Context, path string) (StateStore, error) {
+	if path == "" {
+		path = defaultSQLitePath
+	}
+	db, err := sql.Open("sqlite3", path+"?_busy_timeout=5000&_journal_mode=WAL")
+	if err != nil {
+		return nil, fmt.Errorf("open sqlite: %s", err)
+	}
+	// sqlite allows only one writer
+	db.SetMaxOpenConns(1)
+	s := &sqliteStore{db: db}
+	if err := s.migrate(ctx); err != nil {
+		db.Close()
+		return nil, err
+	}
+	return s, nil
+}
+
+// migrate applies migrations not applied yet, so that upgrading never requires manual operation
+func (s *sqliteStore) migrate(ctx context.Context) error {
+	if _, err := s.db.ExecContext(ctx, `CREATE TABLE IF NOT EXISTS schema_migrations (version INTEGER PRIMARY KEY)`); err != nil {
+		return fmt.Errorf("migrate: %s", err)
+	}
+	var version int
+	if err := s.db.QueryRowContext(ctx, `SELECT COALESCE(MAX(version), 0) FROM schema_migrations`).Scan(&version); err != nil {
+		return fmt.Errorf("migrate: %s", err)
+	}
+	for i := version; i < len(migrations); i++ {
+		tx, err := s.db.BeginTx(ctx, nil)
+		if err != nil {
+			return fmt.Errorf("migrate %d: %s", i+1, err)
+		}
+		if _, err := tx.ExecContext(ctx, migrations[i]); err != nil {
+			tx.Rollback()
+			return fmt.Errorf("migrate %d: %s", i+1, err)
+		}
+		if _, err := tx.ExecContext(ctx, `INSERT INTO schema_migrations (version) VALUES (?)`, i+1); err != nil {
+			tx.Rollback()
+			return fmt.Errorf("migrate %d: %s", i+1, err)
+		}
+		if err := tx.Commit(); err != nil {
+			return fmt.Errorf("migrate %d: %s", i+1, err)
+		}
+	}
+	return nil
+}
+
+func (s *sqliteStore) Close() error {
+	return s.db.Close()
+}
+
+func (s *sqliteStore) ReadToken(ctx context.Context, tenantId string) (string, error) {
+	var token string
+	err := s.db.QueryRowContext(ctx, `SELECT token FROM tokens WHERE tenant = ?`, tenantId).Scan(&token)
+	if errors.Is(err, sql.ErrNoRows) {
+		return "", nil
+	} else if err != nil {
+		return "", fmt.Errorf("sync token: %s", err)
+	}
+	return token, nil
+}
+
+func (s *sqliteStore) SaveToken(ctx context.Context, tenantId string, token string) error {
+	_, err := s.db.ExecContext(ctx,
+		`INSERT INTO tokens (tenant, token) VALUES (?, ?)
+		ON CONFLICT (tenant) DO UPDATE SET token = excluded.token`,
+		tenantId, token)
+	if err != nil {
+		return fmt.Errorf("sync token: %s", err)
+	}
+	return nil
+}
+
+func (s *sqliteStore) CompareAndSwapToken(ctx context.Context, tenantId string, old string, token string) error {
+	var res sql.Result
+	var err error
+	if old == "" {
+		res, err = s.db.ExecContext(ctx,
+			`INSERT INTO tokens (tenant, token) VALUES (?, ?)
+			ON CONFLICT (tenant) DO UPDATE SET token = excluded.token WHERE token = ''`,
+			tenantId, token)
+	} else {
+		res, err = s.db.ExecContext(ctx, `UPDATE tokens SET token = ? WHERE tenant = ? AND token = ?`, token, tenantId, old)
+	}
+	if err != nil {
+		return fmt.Errorf("sync token: %s", err)
+	}
+	if n, err := res.RowsAffected(); err != nil {
+		return fmt.Errorf("sync token: %s", err)
+	} else if n == 0 {
+		return ErrTokenConflict
+	}
+	return nil
+}
+
+func (s *sqliteStore) AcquireLock(ctx context.Context, name string, owner string, ttl time.Duration) (bool, error) {
+	now := time.Now()
+	res, err := s.db.ExecContext(ctx,
+		`INSERT INTO locks (name, owner, expires) VALUES (?, ?, ?)
+		ON CONFLICT (name) DO UPDATE SET owner = excluded.owner, expires = excluded.expires
+		WHERE owner = excluded.owner OR expires <= ?`,
+		name, owner, now.Add(ttl).UnixNano(), now.UnixNano())
+	if err != nil {
+		return false, fmt.Errorf("lock %s: %s", name, err)
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return false, fmt.Errorf("lock %s: %s", name, err)
+	}
+	return n > 0, nil
+}
+
+func (s *sqliteStore) ReleaseLock(ctx context.Context, name string, owner string) error {
+	if _, err := s.db.ExecContext(ctx, `DELETE FROM locks WHERE name = ? AND owner = ?`, name, owner); err != nil {
+		return fmt.Errorf("lock %s: %s", name, err)
+	}
+	return nil
+}
+
+func (s *sqliteStore) ListChannels(ctx context.Context, tenantId string) ([]Channel, error) {
+	rows, err := s.db.QueryContext(ctx,
+		`SELECT channel_id, resource_id, expiration, token, confirmed, created FROM watch_channels WHERE tenant = ?`,
+		tenantId)
+	if err != nil {
+		return nil, fmt.Errorf("channels: %s", err)
+	}
+	defer rows.Close()
+	var channels []Channel
+	for rows.Next() {
+		var ch Channel
+		var created int64
+		if err := rows.Scan(&ch.Id, &ch.ResourceId, &ch.Expiration, &ch.Token, &ch.Confirmed, &created); err != nil {
+			return nil, fmt.Errorf("channels: %s", err)
+		}
+		if created != 0 {
+			ch.Created = time.Unix(0, created)
+		}
+		channels = append(channels, ch)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("channels: %s", err)
+	}
+	return channels, nil
+}
+
+func (s *sqliteStore) SaveChannel(ctx context.Context, tenantId string, ch Channel) error {
+	var created int64
+	if !ch.Created.IsZero() {
+		created = ch.Created.UnixNano()
+	}
+	_, err := s.db.ExecContext(ctx,
+		`INSERT INTO watch_channels (tenant, channel_id, resource_id, expiration, token, confirmed, created)
+		VALUES (?, ?, ?, ?, ?, ?, ?)
+		ON CONFLICT (tenant, channel_id) DO UPDATE SET
+			resource_id = excluded.resource_id, expiration = excluded.expiration, token = excluded.token,
+			confirmed = excluded.confirmed, created = excluded.created`,
+		tenantId, ch.Id, ch.ResourceId, ch.Expiration, ch.Token, ch.Confirmed, created)
+	if err != nil {
+		return fmt.Errorf("channel: %s", err)
+	}
+	return nil
+}
+
+func (s *sqliteStore) SetChannelWatch(ctx context.Context, tenantId string, channelId string, resourceId string, expiration int64) error {
+	return s.updateChannel(ctx, `UPDATE watch_channels SET resource_id = ?, expiration = ? WHERE tenant = ? AND channel_id = ?`,
+		resourceId, expiration, tenantId, channelId)
+}
+
+func (s *sqliteStore) ConfirmChannel(ctx context.Context, tenantId string, channelId string) error {
+	return s.updateChannel(ctx, `UPDATE watch_channels SET confirmed = 1 WHERE tenant = ? AND channel_id = ?`,
+		tenantId, channelId)
+}
+
+func (s *sqliteStore) updateChannel(ctx context.Context, query string, args ...interface{}) error {
+	res, err := s.db.ExecContext(ctx, query, args...)
+	if err != nil {
+		return fmt.Errorf("channel: %s", err)
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return fmt.Errorf("channel: %s", err)
+	}
+	if n == 0 {
+		return ErrUnknownChannel
+	}
+	return nil
+}
+
+func (s *sqliteStore) DeleteChannel(ctx context.Context, tenantId string, channelId string) error {
+	_, err := s.db.ExecContext(ctx, `DELETE FROM watch_channels WHERE tenant = ? AND channel_id = ?`, tenantId, channelId)
+	if err != nil {
+		return fmt.Errorf("channel: %s", err)
+	}
+	return nil
+}
+
+func (s *sqliteStore) ReadMapping(ctx context.Context, tenantId string, srcEventId string) (*Mapping, error) {
+	m := Mapping{SrcEventId: srcEventId}
+	var created, end int64
+	err := s.db.QueryRowContext(ctx,
+		`SELECT dest_event_id, created, end_time FROM mappings WHERE tenant = ? AND src_event_id = ?`, tenantId, srcEventId,
+	).Scan(&m.DestEventId, &created, &end)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, nil
+	} else if err != nil {
+		return nil, fmt.Errorf("mapping: %s", err)
+	}
+	m.Created = time.Unix(0, created)
+	m.End = unixNanoOrZero(end)
+	return &m, nil
+}
+
+// unixNanoOrZero reads time saved by zeroOrUnixNano
+func unixNanoOrZero(n int64) time.Time {
+	if n == 0 {
+		return time.Time{}
+	}
+	return time.Unix(0, n)
+}
+
+func zeroOrUnixNano(t time.Time) int64 {
+	if t.IsZero() {
+		return 0
+	}
+	return t.UnixNano()
+}
+
+func (s *sqliteStore) SaveMapping(ctx context.Context, tenantId string, m Mapping) error {
+	_, err := s.db.ExecContext(ctx,
+		`INSERT INTO mappings (tenant, src_event_id, dest_event_id, created, end_time) VALUES (?, ?, ?, ?, ?)
+		ON CONFLICT (tenant, src_event_id) DO UPDATE SET
+			dest_event_id = excluded.dest_event_id, created = excluded.created, end_time = excluded.end_time`,
+		tenantId, m.SrcEventId, m.DestEventId, m.Created.UnixNano(), zeroOrUnixNano(m.End))
+	if err != nil {
+		return fmt.Errorf("mapping: %s", err)
+	}
+	return nil
+}
+
+func (s *sqliteStore) DeleteMapping(ctx context.Context, tenantId string, srcEventId string) error {
+	_, err := s.db.ExecContext(ctx, `DELETE FROM mappings WHERE tenant = ? AND src_event_id = ?`, tenantId, srcEventId)
+	if err != nil {
+		return fmt.Errorf("mapping: %s", err)
+	}
+	return nil
+}
+
+func (s *sqliteStore) ListMappings(ctx context.Context, tenantId string) ([]Mapping, error) {
+	rows, err := s.db.QueryContext(ctx,
+		`SELECT src_event_id, dest_event_id, created, end_time FROM mappings WHERE tenant = ? ORDER BY created`, tenantId)
+	if err != nil {
+		return nil, fmt.Errorf("mappings: %s", err)
+	}
+	defer rows.Close()
+	var mappings []Mapping
+	for rows.Next() {
+		var m Mapping
+		var created, end int64
+		if err := rows.Scan(&m.SrcEventId, &m.DestEventId, &created, &end); err != nil {
+			return nil, fmt.Errorf("mappings: %s", err)
+		}
+		m.Created = time.Unix(0, created)
+		m.End = unixNanoOrZero(end)
+		mappings = append(mappings, m)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("mappings: %s", err)
+	}
+	return mappings, nil
+}
+
+func (s *sqliteStore) DeleteMappingsBefore(ctx context.Context, tenantId string, t time.Time) (int, error) {
+	res, err := s.db.ExecContext(ctx,
+		`DELETE FROM mappings WHERE tenant = ? AND ((end_time != 0 AND end_time < ?) OR (end_time = 0 AND created < ?))`,
+		tenantId, t.UnixNano(), t.UnixNano())
+	if err != nil {
+		return 0, fmt.Errorf("mappings: %s", err)
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return 0, fmt.Errorf("mappings: %s", err)
+	}
+	return int(n), nil
+}
+
+func (s *sqliteStore) SaveRun(ctx context.Context, tenantId string, r Run) error {
+	failures, err := json.Marshal(r.Failures)
+	if err != nil {
+		return fmt.Errorf("run: %s", err)
+	}
+	_, err = s.db.ExecContext(ctx,
+		`INSERT INTO runs (tenant, id, started, finished, triggered_by, token_before, token_after, seen, created, error, failures)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+		ON CONFLICT (tenant, id) DO UPDATE SET
+			started = excluded.started, finished = excluded.finished, triggered_by = excluded.triggered_by,
+			token_before = excluded.token_before, token_after = excluded.token_after, seen = excluded.seen,
+			created = excluded.created, error = excluded.error, failures = excluded.failures`,
+		tenantId, r.Id, r.Started.UnixNano(), r.Finished.UnixNano(), r.Trigger, r.TokenBefore, r.TokenAfter, r.Seen,
+		r.Created, r.Error, string(failures))
+	if err != nil {
+		return fmt.Errorf("run: %s", err)
+	}
+	return nil
+}
+
+const runColumns = `id, started, finished, triggered_by, token_before, token_after, seen, created, error, failures`
+
+func scanRun(rows interface{ Scan(...interface{}) error }) (Run, error) {
+	var r Run
+	var started, finished int64
+	var failures string
+	if err := rows.Scan(&r.Id, &started, &finished, &r.Trigger, &r.TokenBefore, &r.TokenAfter, &r.Seen,
+		&r.Created, &r.Error, &failures); err != nil {
+		return r, err
+	}
+	if err := json.Unmarshal([]byte(failures), &r.Failures); err != nil {
+		return r, err
+	}
+	r.Started = time.Unix(0, started)
+	r.Finished = time.Unix(0, finished)
+	return r, nil
+}
+
+func (s *sqliteStore) ReadRun(ctx context.Context, tenantId string, runId string) (*Run, error) {
+	r, err := scanRun(s.db.QueryRowContext(ctx,
+		`SELECT `+runColumns+` FROM runs WHERE tenant = ? AND id = ?`, tenantId, runId))
+	if err == sql.ErrNoRows {
+		return nil, nil
+	} else if err != nil {
+		return nil, fmt.Errorf("run: %s", err)
+	}
+	return &r, nil
+}
+
+func (s *sqliteStore) ListRuns(ctx context.Context, tenantId string, limit int) ([]Run, error) {
+	if limit <= 0 {
+		limit = -1 // no limit in sqlite
+	}
+	rows, err := s.db.QueryContext(ctx,
+		`SELECT `+runColumns+` FROM runs WHERE tenant = ? ORDER BY started DESC LIMIT ?`,
+		tenantId, limit)
+	if err != nil {
+		return nil, fmt.Errorf("runs: %s", err)
+	}
+	defer rows.Close()
+	var runs []Run
+	for rows.Next() {
+		r, err := scanRun(rows)
+		if err != nil {
+			return nil, fmt.Errorf("runs: %s", err)
+		}
+		runs = append(runs, r)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("runs: %s", err)
+	}
+	return runs, nil
+}
+
+func (s *sqliteStore) DeleteRunsBefore(ctx context.Context, tenantId string, t time.Time) (int, error) {
+	res, err := s.db.ExecContext(ctx, `DELETE FROM runs WHERE tenant = ? AND started < ?`, tenantId, t.UnixNano())
+	if err != nil {
+		return 0, fmt.Errorf("runs: %s", err)
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return 0, fmt.Errorf("runs: %s", err)
+	}
+	if _, err := s.db.ExecContext(ctx, `DELETE FROM audit WHERE tenant = ? AND time < ?`, tenantId, t.UnixNano()); err != nil {
+		return int(n), fmt.Errorf("audit: %s", err)
+	}
+	return int(n), nil
+}
+
+func (s *sqliteStore) SaveAudit(ctx context.Context, tenantId string, entries []AuditEntry) error {
+	if len(entries) == 0 {
+		return nil
+	}
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("audit: %s", err)
+	}
+	defer tx.Rollback()
+	for _, e := range entries {
+		_, err := tx.ExecContext(ctx,
+			`INSERT OR REPLACE INTO audit (tenant, id, run_id, time, action, src_event_id, dest_event_id, rule, reason)
+			VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+			tenantId, e.Id, e.RunId, e.Time.UnixNano(), e.Action, e.SrcEventId, e.DestEventId, e.Rule, e.Reason)
+		if err != nil {
+			return fmt.Errorf("audit: %s", err)
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("audit: %s", err)
+	}
+	return nil
+}
+
+func (s *sqliteStore) ListAudit(ctx context.Context, tenantId string, q AuditQuery) ([]AuditEntry, error) {
+	query := `SELECT id, run_id, time, action, src_event_id, dest_event_id, rule, reason FROM audit WHERE tenant = ?`
+	args := []interface{}{tenantId}
+	if q.SrcEventId != "" {
+		query += ` AND src_event_id = ?`
+		args = append(args, q.SrcEventId)
+	}
+	if q.DestEventId != "" {
+		query += ` AND dest_event_id = ?`
+		args = append(args, q.DestEventId)
+	}
+	if q.RunId != "" {
+		query += ` AND run_id = ?`
+		args = append(args, q.RunId)
+	}
+	limit := q.Limit
+	if limit <= 0 {
+		limit = -1
+	}
+	query += ` ORDER BY time DESC LIMIT ?`
+	args = append(args, limit)
+	rows, err := s.db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, fmt.Errorf("audit: %s", err)
+	}
+	defer rows.Close()
+	var entries []AuditEntry
+	for rows.Next() {
+		var e AuditEntry
+		var t int64
+		if err := rows.Scan(&e.Id, &e.RunId, &t, &e.Action, &e.SrcEventId, &e.DestEventId, &e.Rule, &e.Reason); err != nil {
+			return nil, fmt.Errorf("audit: %s", err)
+		}
+		e.Time = time.Unix(0, t)
+		entries = append(entries, e)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("audit: %s", err)
+	}
+	return entries, nil
+}
@@ -0,0 +1,181 @@
+package store
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/shiraily/gcal-sync/config"
+	"github.com/shiraily/gcal-sync/retry"
+)
+
+// Channel is a push notification channel watching source calendar
+type Channel struct {
+	Id         string `json:"channelId"`
+	ResourceId string `json:"resourceId"`
+	Expiration int64  `json:"exp"` // unix time in milliseconds
+	// Token is sent back in X-Goog-Channel-Token to authenticate notifications
+	Token string `json:"token,omitempty"`
+	// Confirmed is set when handshake (sync notification) of the channel arrives
+	Confirmed bool      `json:"confirmed,omitempty"`
+	Created   time.Time `json:"created"`
+}
+
+// ExpiresAt returns zero time if expiration is unknown
+func (ch Channel) ExpiresAt() time.Time {
+	if ch.Expiration == 0 {
+		return time.Time{}
+	}
+	return time.Unix(0, ch.Expiration*int64(time.Millisecond))
+}
+
+// Mapping relates source event to the block created for it on destination calendar
+type Mapping struct {
+	SrcEventId  string    `json:"srcEventId"`
+	DestEventId string    `json:"destEventId"`
+	Created     time.Time `json:"created"`
+	// End of the block. Zero for mappings saved before it was recorded.
+	End time.Time `json:"end,omitempty"`
+}
+
+// IsPast reports whether the block ended before t. Unknown end is not past.
+func (m Mapping) IsPast(t time.Time) bool {
+	return !m.End.IsZero() && m.End.Before(t)
+}
+
+// expired means the mapping is pruned by DeleteMappingsBefore(t). One without end is kept
+// until it was created before t.
+func (m Mapping) expired(t time.Time) bool {
+	if m.End.IsZero() {
+		return m.Created.Before(t)
+	}
+	return m.End.Before(t)
+}
+
+// Run is a record of one sync
+type Run struct {
+	Id       string    `json:"id"`
+	Started  time.Time `json:"started"`
+	Finished time.Time `json:"finished"`
+	// Trigger is what started the sync, such as notification or poll
+	Trigger     string `json:"trigger,omitempty"`
+	TokenBefore string `json:"tokenBefore,omitempty"`
+	TokenAfter  string `json:"tokenAfter,omitempty"`
+	// Seen is number of changed source events
+	Seen    int    `json:"seen"`
+	Created int    `json:"created"`
+	Error   string `json:"error,omitempty"`
+	// Failures are events skipped or to be retried in this sync
+	Failures []Failure `json:"failures,omitempty"`
+}
+
+// Failure is an event failed to sync
+type Failure struct {
+	EventId   string `json:"eventId"`
+	Error     string `json:"error"`
+	Transient bool   `json:"transient,omitempty"`
+}
+
+// AuditEntry records an action taken for a source event
+type AuditEntry struct {
+	Id string `json:"id"`
+	// RunId is empty if taken outside of sync, such as by reconcile job
+	RunId       string    `json:"runId,omitempty"`
+	Time        time.Time `json:"time"`
+	Action      string    `json:"action"` // created, patched, deleted, forgotten or skipped
+	SrcEventId  string    `json:"srcEventId"`
+	DestEventId string    `json:"destEventId,omitempty"`
+	Rule        string    `json:"rule,omitempty"`   // match of the rule applied
+	Reason      string    `json:"reason,omitempty"` // why skipped
+}
+
+// AuditQuery filters audit entries. Empty fields match all.
+type AuditQuery struct {
+	SrcEventId  string
+	DestEventId string
+	RunId       string
+	Limit       int
+}
+
+func (q AuditQuery) match(e AuditEntry) bool {
+	return (q.SrcEventId == "" || q.SrcEventId == e.SrcEventId) &&
+		(q.DestEventId == "" || q.DestEventId == e.DestEventId) &&
+		(q.RunId == "" || q.RunId == e.RunId)
+}
+
+// ErrTokenConflict means the sync token was changed by another sync
+var ErrTokenConflict = errors.New("sync token was changed by another sync")
+
+// ErrUnknownChannel means the channel is not saved
+var ErrUnknownChannel = errors.New("unknown channel")
+
+// StateStore persists state of each tenant
+type StateStore interface {
+	// ReadToken returns empty string if no token is saved
+	ReadToken(ctx context.Context, tenantId string) (string, error)
+	SaveToken(ctx context.Context, tenantId string, token string) error
+	// CompareAndSwapToken saves token only if current one is old, otherwise returns ErrTokenConflict
+	CompareAndSwapToken(ctx context.Context, tenantId string, old string, token string) error
+
+	// AcquireLock takes the lock named name for ttl unless another owner holds it.
+	// Holder can extend it by acquiring again.
+	AcquireLock(ctx context.Context, name string, owner string, ttl time.Duration) (bool, error)
+	// ReleaseLock does nothing if owner does not hold the lock
+	ReleaseLock(ctx context.Context, name string, owner string) error
+
+	// ListChannels returns all channels of the tenant. Several are active while renewing.
+	ListChannels(ctx context.Context, tenantId string) ([]Channel, error)
+	// SaveChannel adds channel or updates one with the same id
+	SaveChannel(ctx context.Context, tenantId string, ch Channel) error
+	// SetChannelWatch sets resource id and expiration given by Watch, keeping Confirmed which
+	// handshake may have set in the meantime. It returns ErrUnknownChannel if not saved.
+	SetChannelWatch(ctx context.Context, tenantId string, channelId string, resourceId string, expiration int64) error
+	// ConfirmChannel sets Confirmed keeping other fields. It returns ErrUnknownChannel if not saved.
+	ConfirmChannel(ctx context.Context, tenantId string, channelId string) error
+	DeleteChannel(ctx context.Context, tenantId string, channelId string) error
+
+	// ReadMapping returns nil if the source event has no block
+	ReadMapping(ctx context.Context, tenantId string, srcEventId string) (*Mapping, error)
+	SaveMapping(ctx context.Context, tenantId string, m Mapping) error
+	DeleteMapping(ctx context.Context, tenantId string, srcEventId string) error
+	ListMappings(ctx context.Context, tenantId string) ([]Mapping, error)
+	// DeleteMappingsBefore deletes mappings of blocks ended before t, or without end and created before t,
+	// and returns number of them
+	DeleteMappingsBefore(ctx context.Context, tenantId string, t time.Time) (int, error)
+
+	SaveRun(ctx context.Context, tenantId string, r Run) error
+	// ReadRun returns nil if not found
+	ReadRun(ctx context.Context, tenantId string, runId string) (*Run, error)
+	// ListRuns returns recent runs, newest first
+	ListRuns(ctx context.Context, tenantId string, limit int) ([]Run, error)
+	// DeleteRunsBefore deletes runs started before t and audit entries before t,
+	// and returns number of the runs
+	DeleteRunsBefore(ctx context.Context, tenantId string, t time.Time) (int, error)
+
+	SaveAudit(ctx context.Context, tenantId string, entries []AuditEntry) error
+	// ListAudit returns entries matching q, newest first
+	ListAudit(ctx context.Context, tenantId string, q AuditQuery) ([]AuditEntry, error)
+
+	Close() error
+}
+
+// Open creates the backend chosen in config
+func Open(ctx context.Context, conf *config.Config, credentialFile string) (StateStore, error) {
+	switch conf.Store.Type {
+	case "", "firestore":
+		s, err := NewFirestoreStore(ctx, conf.Project, credentialFile)
+		if err != nil {
+			return nil, err
+		}
+		return withRetry(s, "firestore", retry.For(conf.Retry, "firestore")), nil
+	case "file":
+		return NewFileStore(conf.Store.Path)
+	case "sqlite":
+		return NewSQLiteStore(ctx, conf.Store.Path)
+	case "memory":
+		return NewMemoryStore(), nil
+	default:
+		return nil, fmt.Errorf("unknown store type: %s", conf.Store.Type)
+	}
+}